@@ -0,0 +1,199 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const apiDevicesPath = "/api/v1/devices/"
+
+// apiSchema is the JSON Schema of the responses of the devices api
+//
+//go:embed api.schema.json
+var apiSchema []byte
+
+// DeviceStatus is the latest rawData of a device
+type DeviceStatus struct {
+	Device string `json:"device"`
+	Model  string `json:"model"`
+	// DeviceTime is the clock of the SBMS0, which has no timezone; it's left out when the clock isn't set
+	DeviceTime   *time.Time               `json:"deviceTime,omitempty"`
+	PolledAt     time.Time                `json:"polledAt"`
+	CapacityUnit string                   `json:"capacityUnit"`
+	GraphUnit    string                   `json:"graphUnit"`
+	Readings     map[string]StatusReading `json:"readings"`
+	Cells        []StatusCell             `json:"cells"`
+	Flags        []StatusFlag             `json:"flags"`
+	Averages     []StatusAverage          `json:"averages"`
+	// DMPPTChannelCurrents are only there when a DMPPT450 is attached
+	DMPPTChannelCurrents []StatusReading `json:"dmpptChannelCurrents,omitempty"`
+}
+
+type StatusReading struct {
+	Value float64 `json:"value"`
+	Unit  string  `json:"unit,omitempty"`
+}
+
+type StatusCell struct {
+	Cell      int  `json:"cell"`
+	Voltage   int  `json:"voltage"`
+	Balancing bool `json:"balancing"`
+}
+
+type StatusFlag struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Problem     bool   `json:"problem"`
+	Set         bool   `json:"set"`
+}
+
+type StatusAverage struct {
+	Source string  `json:"source"`
+	Window string  `json:"window"`
+	Value  float64 `json:"value"`
+	Unit   string  `json:"unit"`
+}
+
+// DeviceTasks is the latest task table of the debug endpoint of a device
+type DeviceTasks struct {
+	Device   string       `json:"device"`
+	PolledAt time.Time    `json:"polledAt"`
+	Tasks    []StatusTask `json:"tasks"`
+}
+
+type StatusTask struct {
+	Name           string  `json:"name"`
+	State          float64 `json:"state"`
+	Priority       float64 `json:"priority"`
+	RunTime        float64 `json:"runTime"`
+	RunTimePercent float64 `json:"runTimePercent"`
+}
+
+// newDeviceStatus has the readings fieldValues has for data, with their units, plus the
+// cell voltage range and DMPPT firmware version; the clock of the device is read in loc
+func newDeviceStatus(name string, data *SBMSData, polledAt time.Time, loc *time.Location) DeviceStatus {
+	status := DeviceStatus{
+		Device:       name,
+		Model:        data.model,
+		PolledAt:     polledAt,
+		CapacityUnit: data.capacityUnit,
+		GraphUnit:    data.graphUnit,
+		Readings: map[string]StatusReading{
+			"min_cell_voltage": {Value: float64(data.minMV), Unit: "mV"},
+			"max_cell_voltage": {Value: float64(data.maxMV), Unit: "mV"},
+		},
+		Cells:    []StatusCell{},
+		Flags:    []StatusFlag{},
+		Averages: []StatusAverage{},
+	}
+	if deviceTime, err := parseDeviceTime(data.ts, loc); err == nil {
+		status.DeviceTime = &deviceTime
+	}
+
+	for _, f := range dataFields {
+		if f.has != nil && !f.has(data) {
+			continue
+		}
+		status.Readings[f.name] = StatusReading{Value: f.value(data), Unit: f.unit}
+	}
+	for i, cell := range data.cells {
+		status.Cells = append(status.Cells, StatusCell{Cell: i + 1, Voltage: cell.mV, Balancing: cell.isBalancing})
+	}
+	for _, f := range flagFields {
+		status.Flags = append(status.Flags, StatusFlag{Name: f.name, Description: f.help, Problem: f.problem, Set: f.value(data.flags)})
+	}
+	// the averages are in A, or in W when the graphs are shown in W
+	averageUnit := "A"
+	if data.graphUnit == graphUnitWatts {
+		averageUnit = "W"
+	}
+	for _, a := range data.averages {
+		status.Averages = append(status.Averages, StatusAverage{Source: a.source, Window: a.window, Value: a.value, Unit: averageUnit})
+	}
+	if data.dmppt != nil {
+		status.Readings["dmppt_version"] = StatusReading{Value: data.dmppt.version}
+		for _, current := range data.dmppt.channelCurrents {
+			status.DMPPTChannelCurrents = append(status.DMPPTChannelCurrents, StatusReading{Value: current, Unit: "mA"})
+		}
+	}
+	return status
+}
+
+func newDeviceTasks(name string, tasks []SystemTaskInfo, polledAt time.Time) DeviceTasks {
+	out := DeviceTasks{Device: name, PolledAt: polledAt, Tasks: make([]StatusTask, 0, len(tasks))}
+	for _, t := range tasks {
+		out.Tasks = append(out.Tasks, StatusTask{
+			Name:           t.name,
+			State:          t.state,
+			Priority:       t.priority,
+			RunTime:        t.runTimeCounter,
+			RunTimePercent: t.runTimePercent,
+		})
+	}
+	return out
+}
+
+// APIHandler serves the latest polls of the devices as json, at /api/v1/devices/<id>/status
+// and /api/v1/devices/<id>/tasks, and their graph history at /api/v1/devices/<id>/history,
+// where the id of an unnamed device is the host of its url
+type APIHandler struct {
+	devices   map[string]*devicePollers
+	histories map[string]HistoryHandler
+	// location is the timezone of the clocks of the devices
+	location *time.Location
+}
+
+func (h APIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name, endpoint, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, apiDevicesPath), "/")
+	pollers, ok := h.devices[name]
+	if !ok {
+		http.Error(w, "unknown device "+name, http.StatusNotFound)
+		return
+	}
+
+	switch endpoint {
+	case "status":
+		if pollers.rawData == nil {
+			http.Error(w, "the rawdata collector is not enabled", http.StatusNotFound)
+			return
+		}
+		result := pollers.rawData.Result()
+		if !result.HasLatest {
+			http.Error(w, "the device has not been polled yet", http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, newDeviceStatus(name, result.Latest, result.LastSuccess, h.location))
+	case "tasks":
+		if pollers.system == nil {
+			http.Error(w, "the system collector is not enabled", http.StatusNotFound)
+			return
+		}
+		result := pollers.system.Result()
+		if !result.HasLatest {
+			http.Error(w, "the device has not been polled yet", http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, newDeviceTasks(name, result.Latest, result.LastSuccess))
+	case "history":
+		h.histories[name].ServeHTTP(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveAPISchema serves the JSON Schema of the devices api
+func serveAPISchema(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	_, _ = w.Write(apiSchema)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("could not write response", "err", err)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeviceStatus(t *testing.T) {
+	data, err := Decode(readFileContent(t, "./__source__/rawData6"))
+	assert.Nil(t, err)
+	polledAt := time.Unix(1700000000, 0)
+	perth, err := time.LoadLocation("Australia/Perth")
+	assert.Nil(t, err)
+	status := newDeviceStatus("shed", data, polledAt, perth)
+
+	assert.Equal(t, "shed", status.Device)
+	assert.Equal(t, "SBMS0", status.Model)
+	assert.Equal(t, time.Date(2024, 2, 20, 13, 32, 56, 0, perth), *status.DeviceTime)
+	assert.Equal(t, polledAt, status.PolledAt)
+	assert.Equal(t, StatusReading{Value: 69, Unit: "%"}, status.Readings["soc"])
+	assert.Equal(t, StatusReading{Value: 26479, Unit: "mV"}, status.Readings["battery_voltage"])
+	assert.Equal(t, StatusReading{Value: 725043.8, Unit: "Wh"}, status.Readings["energy_pv1_wh"])
+	assert.Contains(t, status.Readings, "min_cell_voltage")
+	assert.NotContains(t, status.Readings, "dmppt_voltage")
+	assert.Equal(t, StatusCell{Cell: 1, Voltage: 3310, Balancing: false}, status.Cells[0])
+	assert.Contains(t, status.Flags, StatusFlag{Name: "cfet", Description: "Charge FET", Set: true})
+	assert.Len(t, status.Flags, len(flagFields))
+	assert.Empty(t, status.DMPPTChannelCurrents)
+}
+
+func TestDeviceTasks(t *testing.T) {
+	tasks := newDeviceTasks("shed", []SystemTaskInfo{{name: "loopTask", state: 1, priority: 1, runTimeCounter: 10, runTimePercent: 18}}, time.Unix(0, 0))
+	assert.Equal(t, []StatusTask{{Name: "loopTask", State: 1, Priority: 1, RunTime: 10, RunTimePercent: 18}}, tasks.Tasks)
+
+	b, err := json.Marshal(newDeviceTasks("shed", nil, time.Unix(0, 0)))
+	assert.Nil(t, err)
+	assert.Contains(t, string(b), `"tasks":[]`)
+}
+
+// schemaKeys are the properties and required properties of a definition of the api schema
+func schemaKeys(t *testing.T, def string) (properties, required []string) {
+	var schema struct {
+		Defs map[string]struct {
+			Properties map[string]any `json:"properties"`
+			Required   []string       `json:"required"`
+		} `json:"$defs"`
+	}
+	assert.Nil(t, json.Unmarshal(apiSchema, &schema))
+	for key := range schema.Defs[def].Properties {
+		properties = append(properties, key)
+	}
+	sort.Strings(properties)
+	return properties, schema.Defs[def].Required
+}
+
+func objectKeys(t *testing.T, v any) []string {
+	b, err := json.Marshal(v)
+	assert.Nil(t, err)
+	var object map[string]any
+	assert.Nil(t, json.Unmarshal(b, &object))
+	var keys []string
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// TestAPISchema keeps the schema in step with the responses
+func TestAPISchema(t *testing.T) {
+	data, err := Decode(readFileContent(t, "./__source__/rawData6"))
+	assert.Nil(t, err)
+	status := newDeviceStatus("shed", data, time.Now(), time.UTC)
+	status.DMPPTChannelCurrents = []StatusReading{{Value: 1, Unit: "mA"}}
+	task := newDeviceTasks("shed", []SystemTaskInfo{{name: "loopTask"}}, time.Now())
+
+	for def, v := range map[string]any{
+		"DeviceStatus": status,
+		"Reading":      status.Readings["soc"],
+		"Cell":         status.Cells[0],
+		"Flag":         status.Flags[0],
+		"Average":      status.Averages[0],
+		"DeviceTasks":  task,
+		"Task":         task.Tasks[0],
+	} {
+		properties, required := schemaKeys(t, def)
+		keys := objectKeys(t, v)
+		assert.Equal(t, properties, keys, def)
+		assert.Subset(t, keys, required, def)
+	}
+}
+
+func TestAPIHandler(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rawData", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(readFileContent(t, "./__source__/rawData6"))
+	})
+	mux.HandleFunc("/debug", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(readFileContent(t, "./__source__/debug1"))
+	})
+	device := httptest.NewServer(mux)
+	defer device.Close()
+
+	config := configWithDevices(DeviceConfig{Name: "shed", URL: device.URL}, DeviceConfig{Name: "boat", URL: "127.0.0.1:1"})
+	config.Client.Retries = 0
+	var loadErr error
+	exporter := testExporter(t, &config, &loadErr)
+	assert.Eventually(t, func() bool {
+		return get(exporter, http.MethodGet, "/api/v1/devices/shed/tasks").Code == http.StatusOK
+	}, time.Second, 10*time.Millisecond)
+
+	rec := get(exporter, http.MethodGet, "/api/v1/devices/shed/status")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var status DeviceStatus
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &status))
+	assert.Equal(t, "shed", status.Device)
+	assert.Equal(t, 69.0, status.Readings["soc"].Value)
+
+	rec = get(exporter, http.MethodGet, "/api/v1/devices/shed/tasks")
+	var tasks DeviceTasks
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &tasks))
+	assert.Equal(t, "async_tcp", tasks.Tasks[0].Name)
+
+	assert.Equal(t, http.StatusServiceUnavailable, get(exporter, http.MethodGet, "/api/v1/devices/boat/status").Code)
+	assert.Equal(t, http.StatusNotFound, get(exporter, http.MethodGet, "/api/v1/devices/cabin/status").Code)
+
+	// the history of each device is fetched from that device
+	rec = get(exporter, http.MethodGet, "/api/v1/devices/shed/history")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var history History
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &history))
+	assert.Len(t, history.Series, len(historySeries))
+	assert.Equal(t, http.StatusBadGateway, get(exporter, http.MethodGet, "/api/v1/devices/boat/history").Code)
+	assert.Equal(t, http.StatusNotFound, get(exporter, http.MethodGet, "/api/v1/devices/cabin/history").Code)
+	// /api/history can't tell which device is meant
+	assert.Equal(t, http.StatusNotFound, get(exporter, http.MethodGet, "/api/history").Code)
+
+	rec = get(exporter, http.MethodGet, "/api/v1/schema.json")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.True(t, json.Valid(rec.Body.Bytes()))
+}
+
+func TestDeviceStatusDMPPT(t *testing.T) {
+	data, err := Decode(readFileContent(t, "./__source__/rawData12"))
+	assert.Nil(t, err)
+	status := newDeviceStatus("shed", data, time.Now(), time.UTC)
+
+	assert.Equal(t, "mV", status.Readings["dmppt_voltage"].Unit)
+	assert.Equal(t, "mA", status.Readings["dmppt_pv1_out_current"].Unit)
+	assert.Equal(t, "mA", status.Readings["dmppt_pv2_out_current"].Unit)
+	assert.Len(t, status.DMPPTChannelCurrents, len(data.dmppt.channelCurrents))
+	for i, current := range status.DMPPTChannelCurrents {
+		assert.Equal(t, StatusReading{Value: data.dmppt.channelCurrents[i], Unit: "mA"}, current)
+	}
+}
+
+// TestAPIHandlerUnnamedDevice checks the device of a config with only a url is served by its host
+func TestAPIHandlerUnnamedDevice(t *testing.T) {
+	device := serveContent(readFileContent(t, "./__source__/rawData6"), http.StatusOK)
+	defer device.Close()
+
+	config := configWithDevices(DeviceConfig{URL: device.URL})
+	config.Collectors = []string{collectorRawData}
+	var loadErr error
+	exporter := testExporter(t, &config, &loadErr)
+	host := strings.TrimPrefix(device.URL, "http://")
+	assert.Eventually(t, func() bool {
+		return get(exporter, http.MethodGet, "/api/v1/devices/"+host+"/status").Code == http.StatusOK
+	}, time.Second, 10*time.Millisecond)
+
+	var status DeviceStatus
+	assert.Nil(t, json.Unmarshal(get(exporter, http.MethodGet, "/api/v1/devices/"+host+"/status").Body.Bytes(), &status))
+	assert.Equal(t, host, status.Device)
+	assert.Equal(t, 69.0, status.Readings["soc"].Value)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// historyMetric is the metric of the graph history. The graphs are drawn relative to
+// their own scale, which rawData doesn't carry, so the bar heights can't be turned back
+// into the readings; they show the shape of a gap rather than fill sbms_pv1_current & co.
+const (
+	historyMetric     = "sbms_history_level"
+	historyMetricHelp = "Bar height of the SBMS0 graph, from 0 to 90, relative to the scale of the graph"
+)
+
+// writeOpenMetrics writes the graph history as OpenMetrics with timestamps,
+// which can be turned into a TSDB block with
+// `promtool tsdb create-blocks-from openmetrics <file> <data dir>`
+func writeOpenMetrics(w io.Writer, history *History) error {
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", historyMetric, historyMetricHelp, historyMetric); err != nil {
+		return err
+	}
+	for _, series := range history.Series {
+		for _, sample := range series.Samples {
+			ts := float64(sample.Timestamp.UnixMilli()) / 1000
+			if _, err := fmt.Fprintf(w, "%s{series=%q} %g %.3f\n", historyMetric, series.Name, sample.Value, ts); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := fmt.Fprint(w, "# EOF\n")
+	return err
+}
+
+func readRawData(input string) ([]byte, error) {
+	if input != "" {
+		return os.ReadFile(input)
+	}
+
+	u, err := getURL(os.Getenv("URL"))
+	if err != nil {
+		return nil, err
+	}
+	return NewDeviceClient(defaultClientConfig(), nil).Get(context.Background(), u)
+}
+
+// runBackfill implements the `backfill` subcommand, which writes the graph history
+// of the SBMS0 as OpenMetrics, to see what happened during a gap
+func runBackfill(args []string) error {
+	fs := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	input := fs.String("input", "", "read rawData from this file instead of the device at $URL")
+	output := fs.String("output", "", "write OpenMetrics to this file instead of stdout")
+	timezone := fs.String("device-timezone", firstNonEmpty(os.Getenv("DEVICE_TIMEZONE"), defaultDeviceTimezone), "IANA timezone the clock of the device is set to (env DEVICE_TIMEZONE)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	loc, err := time.LoadLocation(*timezone)
+	if err != nil {
+		return fmt.Errorf("device-timezone: %w", err)
+	}
+	b, err := readRawData(*input)
+	if err != nil {
+		return err
+	}
+	history, err := decodeHistory(b, loc, deviceLogger(slog.Default(), "", firstNonEmpty(*input, os.Getenv("URL"))))
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return writeOpenMetrics(w, history)
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteOpenMetricsRawData6(t *testing.T) {
+	history, err := decodeHistory(readFileContent(t, "./__source__/rawData6"), time.UTC, slog.Default())
+	assert.Nil(t, err)
+
+	var b bytes.Buffer
+	assert.Nil(t, writeOpenMetrics(&b, history))
+
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	assert.Len(t, lines, 2+(6*historyLength)+1)
+	assert.Equal(t, "# TYPE sbms_history_level gauge", lines[1])
+	assert.Equal(t, "# EOF", lines[len(lines)-1])
+
+	last := history.Series[0].Samples[historyLength-1]
+	assert.Equal(t, fmt.Sprintf(`sbms_history_level{series="PV1"} 39 %d.000`, last.Timestamp.Unix()), lines[1+historyLength])
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRetries          = 2
+	defaultRetryBackoff     = 200 * time.Millisecond
+	defaultBreakerFailures  = 5
+	defaultBreakerCooldown  = time.Minute
+	maxRetryBackoffExponent = 6
+)
+
+// the states of the circuit breaker, as exported by sbms_device_circuit_state
+const (
+	circuitClosed   = 0
+	circuitOpen     = 1
+	circuitHalfOpen = 2
+)
+
+// ErrCircuitOpen is returned without calling the device while the circuit breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// ClientConfig is how a DeviceClient talks to the ESP32
+type ClientConfig struct {
+	// Timeout is the timeout of each attempt
+	Timeout time.Duration `yaml:"timeout"`
+	// Retries is how many times a failed request is tried again
+	Retries int `yaml:"retries"`
+	// RetryBackoff is the wait before the first retry, doubling with every retry
+	RetryBackoff time.Duration `yaml:"retry_backoff"`
+	// BreakerFailures is how many requests in a row must fail for the circuit breaker to open
+	BreakerFailures int `yaml:"breaker_failures"`
+	// BreakerCooldown is how long the circuit breaker stays open before trying the device again
+	BreakerCooldown time.Duration `yaml:"breaker_cooldown"`
+}
+
+func defaultClientConfig() ClientConfig {
+	return ClientConfig{
+		Timeout:         defaultTimeout,
+		Retries:         defaultRetries,
+		RetryBackoff:    defaultRetryBackoff,
+		BreakerFailures: defaultBreakerFailures,
+		BreakerCooldown: defaultBreakerCooldown,
+	}
+}
+
+func (c ClientConfig) validate() error {
+	if c.Timeout <= 0 {
+		return fmt.Errorf("timeout must be positive, not %s", c.Timeout)
+	}
+	if c.Retries < 0 {
+		return fmt.Errorf("retries must not be negative, not %d", c.Retries)
+	}
+	if c.RetryBackoff < 0 {
+		return fmt.Errorf("retry_backoff must not be negative, not %s", c.RetryBackoff)
+	}
+	if c.BreakerFailures <= 0 {
+		return fmt.Errorf("breaker_failures must be positive, not %d", c.BreakerFailures)
+	}
+	if c.BreakerCooldown <= 0 {
+		return fmt.Errorf("breaker_cooldown must be positive, not %s", c.BreakerCooldown)
+	}
+	return nil
+}
+
+// DeviceClient gets the endpoints of one ESP32. Each attempt has a timeout, failed requests
+// are retried with jittered backoff, and after BreakerFailures failed requests in a row the
+// circuit breaker opens, so the device isn't called at all until BreakerCooldown has passed.
+type DeviceClient struct {
+	config  ClientConfig
+	flights *flightGroup
+	http    *http.Client
+	now     func() time.Time
+	sleep   func(ctx context.Context, d time.Duration) error
+
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+}
+
+// NewDeviceClient creates a client that coalesces its requests with the others of flights
+func NewDeviceClient(config ClientConfig, flights *flightGroup) *DeviceClient {
+	return &DeviceClient{
+		config:  config,
+		flights: flights,
+		http:    &http.Client{},
+		now:     time.Now,
+		sleep:   sleepContext,
+	}
+}
+
+// State is the state of the circuit breaker
+func (c *DeviceClient) State() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.updateState()
+	return c.state
+}
+
+// updateState moves an open circuit breaker to half-open once the cooldown has passed
+func (c *DeviceClient) updateState() {
+	if c.state == circuitOpen && c.now().Sub(c.openedAt) >= c.config.BreakerCooldown {
+		c.state = circuitHalfOpen
+	}
+}
+
+// allow is whether a request may be sent to the device
+func (c *DeviceClient) allow() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.updateState()
+	return c.state != circuitOpen
+}
+
+// record updates the circuit breaker with the outcome of a request
+func (c *DeviceClient) record(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil {
+		c.state = circuitClosed
+		c.failures = 0
+		return
+	}
+	c.failures++
+	if c.state == circuitHalfOpen || c.failures >= c.config.BreakerFailures {
+		c.state = circuitOpen
+		c.openedAt = c.now()
+	}
+}
+
+// Get gets url, retrying failed attempts unless ctx is done, or waits for
+// a request for url that is already in flight
+func (c *DeviceClient) Get(ctx context.Context, url string) ([]byte, error) {
+	return c.flights.do(ctx, url, func(ctx context.Context) ([]byte, error) {
+		return c.getWithRetries(ctx, url)
+	})
+}
+
+func (c *DeviceClient) getWithRetries(ctx context.Context, url string) ([]byte, error) {
+	if !c.allow() {
+		return nil, &ScrapeError{Stage: stageHTTP, Err: ErrCircuitOpen}
+	}
+
+	var err error
+	for attempt := 0; attempt <= c.config.Retries; attempt++ {
+		if attempt > 0 {
+			if sleepErr := c.sleep(ctx, c.backoff(attempt)); sleepErr != nil {
+				break
+			}
+		}
+		var b []byte
+		b, err = c.get(ctx, url)
+		if err == nil {
+			c.record(nil)
+			return b, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	c.record(err)
+	return nil, err
+}
+
+// backoff is how long to wait before the retry, with up to as much jitter again
+// so that devices that failed together don't retry together
+func (c *DeviceClient) backoff(attempt int) time.Duration {
+	if c.config.RetryBackoff <= 0 {
+		return 0
+	}
+	d := c.config.RetryBackoff << min(attempt-1, maxRetryBackoffExponent)
+	return d + time.Duration(rand.Int63n(int64(d)))
+}
+
+// get makes one attempt
+func (c *DeviceClient) get(ctx context.Context, url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.config.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, &ScrapeError{Stage: stageHTTP, Err: err}
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, &ScrapeError{Stage: stageHTTP, Err: err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &ScrapeError{Stage: stageHTTP, Err: fmt.Errorf("unexpected status %s", resp.Status)}
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &ScrapeError{Stage: stageRead, Err: err}
+	}
+	return b, nil
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingServer counts requests and answers them with handler
+func countingServer(handler func(n int32, w http.ResponseWriter, r *http.Request)) (*httptest.Server, *atomic.Int32) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler(requests.Add(1), w, r)
+	}))
+	return server, &requests
+}
+
+func resetConnection(w http.ResponseWriter) {
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err == nil {
+		_ = conn.Close()
+	}
+}
+
+func TestDeviceClientTimesOutStalledDevice(t *testing.T) {
+	device, requests := countingServer(func(_ int32, w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+	defer device.Close()
+
+	client := NewDeviceClient(ClientConfig{Timeout: 50 * time.Millisecond, Retries: 1, BreakerFailures: 5, BreakerCooldown: time.Minute}, nil)
+	start := time.Now()
+	_, err := client.Get(context.Background(), device.URL)
+	assert.Less(t, time.Since(start), 2*time.Second)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, stageHTTP, scrapeErrorStage(err))
+	assert.Equal(t, int32(2), requests.Load())
+}
+
+func TestDeviceClientRetriesReset(t *testing.T) {
+	device, requests := countingServer(func(n int32, w http.ResponseWriter, r *http.Request) {
+		if n < 3 {
+			resetConnection(w)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	})
+	defer device.Close()
+
+	client := NewDeviceClient(ClientConfig{Timeout: time.Second, Retries: 2, RetryBackoff: time.Millisecond, BreakerFailures: 5, BreakerCooldown: time.Minute}, nil)
+	b, err := client.Get(context.Background(), device.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, "ok", string(b))
+	assert.Equal(t, int32(3), requests.Load())
+	assert.Equal(t, circuitClosed, client.State())
+}
+
+func TestDeviceClientGivesUpAfterRetries(t *testing.T) {
+	device, requests := countingServer(func(_ int32, w http.ResponseWriter, r *http.Request) {
+		resetConnection(w)
+	})
+	defer device.Close()
+
+	client := NewDeviceClient(ClientConfig{Timeout: time.Second, Retries: 2, BreakerFailures: 5, BreakerCooldown: time.Minute}, nil)
+	_, err := client.Get(context.Background(), device.URL)
+	assert.NotNil(t, err)
+	assert.Equal(t, int32(3), requests.Load())
+}
+
+func TestDeviceClientStopsRetryingWhenCancelled(t *testing.T) {
+	device, requests := countingServer(func(_ int32, w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	defer device.Close()
+
+	client := NewDeviceClient(ClientConfig{Timeout: time.Second, Retries: 5, RetryBackoff: time.Hour, BreakerFailures: 5, BreakerCooldown: time.Minute}, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := client.Get(ctx, device.URL)
+	assert.NotNil(t, err)
+	assert.Equal(t, int32(1), requests.Load())
+}
+
+func TestDeviceClientCircuitBreaker(t *testing.T) {
+	var healthy atomic.Bool
+	device, requests := countingServer(func(_ int32, w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			resetConnection(w)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	})
+	defer device.Close()
+
+	now := time.Now()
+	client := NewDeviceClient(ClientConfig{Timeout: time.Second, BreakerFailures: 2, BreakerCooldown: time.Minute}, nil)
+	client.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		_, err := client.Get(context.Background(), device.URL)
+		assert.NotNil(t, err)
+	}
+	assert.Equal(t, circuitOpen, client.State())
+
+	// while open the device isn't called
+	_, err := client.Get(context.Background(), device.URL)
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+	assert.Equal(t, int32(2), requests.Load())
+
+	// after the cooldown one request is let through, and opens the circuit again if it fails
+	now = now.Add(time.Minute)
+	assert.Equal(t, circuitHalfOpen, client.State())
+	_, err = client.Get(context.Background(), device.URL)
+	assert.NotNil(t, err)
+	assert.NotErrorIs(t, err, ErrCircuitOpen)
+	assert.Equal(t, circuitOpen, client.State())
+
+	now = now.Add(time.Minute)
+	healthy.Store(true)
+	b, err := client.Get(context.Background(), device.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, "ok", string(b))
+	assert.Equal(t, circuitClosed, client.State())
+}
+
+func TestDeviceClientBackoffJitter(t *testing.T) {
+	client := NewDeviceClient(ClientConfig{RetryBackoff: 100 * time.Millisecond}, nil)
+	for attempt, base := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 3: 400 * time.Millisecond} {
+		for i := 0; i < 20; i++ {
+			d := client.backoff(attempt)
+			assert.GreaterOrEqual(t, d, base)
+			assert.Less(t, d, 2*base)
+		}
+	}
+}
+
+func TestCollectCircuitState(t *testing.T) {
+	device := serveContent(nil, http.StatusInternalServerError)
+	defer device.Close()
+
+	config := testClientConfig()
+	config.BreakerFailures = 1
+	poller := NewPoller(device.URL, defaultPollInterval, NewDeviceClient(config, nil), slog.Default(), Decode)
+	poller.Poll(context.Background())
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewSBMS0Collector(poller, newEnergyTracker(), defaultMetricPrefix, nil))
+	err := testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP sbms_device_circuit_state State of the circuit breaker of the SBMS0: 0 closed, 1 open, 2 half-open
+# TYPE sbms_device_circuit_state gauge
+sbms_device_circuit_state 1
+`), "sbms_device_circuit_state")
+	assert.Nil(t, err)
+}
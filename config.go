@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	defaultListenAddress = ":9000"
+	defaultMetricPrefix  = "sbms"
+	defaultTimeout       = 5 * time.Second
+	// defaultDeviceTimezone is the timezone of the exporter, the TZ environment variable
+	defaultDeviceTimezone = "Local"
+)
+
+// the collectors that can be enabled
+const (
+	collectorRawData = "rawdata"
+	collectorSystem  = "system"
+	collectorGo      = "go"
+	collectorProcess = "process"
+)
+
+var knownCollectors = []string{collectorRawData, collectorSystem, collectorGo, collectorProcess}
+
+// Config is the file given by --config.file, e.g.
+//
+//	listen_address: ":9000"
+//	poll_interval: 10s
+//	timeout: 5s
+//	retries: 2
+//	retry_backoff: 200ms
+//	breaker_failures: 5
+//	breaker_cooldown: 1m
+//	metric_prefix: sbms
+//	device_timezone: Europe/Berlin
+//	collectors: [rawdata, system]
+//	sinks:
+//	  prometheus:
+//	    enabled: true
+//	  mqtt:
+//	    enabled: true
+//	    broker: tcp://localhost:1883
+//	  influxdb:
+//	    enabled: true
+//	    url: http://localhost:8086
+//	    bucket: solar
+//	  otlp:
+//	    enabled: true
+//	    endpoint: localhost:4317
+//	devices:
+//	  - name: shed
+//	    url: 192.168.1.10
+//	    site: home
+//	    battery_bank: a
+//	log:
+//	  level: info
+//	  format: text
+//	state:
+//	  path: /var/lib/sbms_exporter/state.json
+//	  save_interval: 1m
+type Config struct {
+	ListenAddress string        `yaml:"listen_address"`
+	PollInterval  time.Duration `yaml:"poll_interval"`
+	Client        ClientConfig  `yaml:",inline"`
+	MetricPrefix  string        `yaml:"metric_prefix"`
+	// DeviceTimezone is the IANA timezone the clocks of the devices are set to, as they have none
+	DeviceTimezone string         `yaml:"device_timezone"`
+	Collectors     []string       `yaml:"collectors"`
+	Sinks          SinksConfig    `yaml:"sinks"`
+	Devices        []DeviceConfig `yaml:"devices"`
+	Log            LogConfig      `yaml:"log"`
+	State          StateConfig    `yaml:"state"`
+}
+
+// SinksConfig is where the polled data is sent
+type SinksConfig struct {
+	Prometheus PrometheusSinkConfig `yaml:"prometheus"`
+	MQTT       MQTTSinkConfig       `yaml:"mqtt"`
+	InfluxDB   InfluxDBSinkConfig   `yaml:"influxdb"`
+	OTLP       OTLPSinkConfig       `yaml:"otlp"`
+}
+
+// PrometheusSinkConfig serves the polled data to be scraped
+type PrometheusSinkConfig struct {
+	Enabled    bool   `yaml:"enabled"`
+	Path       string `yaml:"path"`
+	SystemPath string `yaml:"system_path"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		ListenAddress:  defaultListenAddress,
+		PollInterval:   defaultPollInterval,
+		Client:         defaultClientConfig(),
+		MetricPrefix:   defaultMetricPrefix,
+		DeviceTimezone: defaultDeviceTimezone,
+		Collectors:     []string{collectorRawData, collectorSystem},
+		Log:            defaultLogConfig(),
+		State:          defaultStateConfig(),
+		Sinks: SinksConfig{
+			Prometheus: PrometheusSinkConfig{Enabled: true, Path: "/metrics", SystemPath: "/metrics_system"},
+			MQTT:       defaultMQTTSinkConfig(),
+			InfluxDB:   defaultInfluxDBSinkConfig(),
+			OTLP:       defaultOTLPSinkConfig(),
+		},
+	}
+}
+
+// deviceLocation is the timezone of the clocks of the devices
+func (c *Config) deviceLocation() *time.Location {
+	loc, err := time.LoadLocation(c.DeviceTimezone)
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+// collectorEnabled is whether name is listed in collectors
+func (c *Config) collectorEnabled(name string) bool {
+	return slices.Contains(c.Collectors, name)
+}
+
+func (c *Config) validate() error {
+	if c.ListenAddress == "" {
+		return errors.New("listen_address is empty")
+	}
+	if c.PollInterval <= 0 {
+		return fmt.Errorf("poll_interval must be positive, not %s", c.PollInterval)
+	}
+	if err := c.Client.validate(); err != nil {
+		return err
+	}
+	if err := c.Log.validate(); err != nil {
+		return err
+	}
+	if err := c.State.validate(); err != nil {
+		return err
+	}
+	if err := c.Sinks.MQTT.validate(); err != nil {
+		return err
+	}
+	if err := c.Sinks.InfluxDB.validate(); err != nil {
+		return err
+	}
+	if err := c.Sinks.OTLP.validate(); err != nil {
+		return err
+	}
+	if c.MetricPrefix == "" {
+		return errors.New("metric_prefix is empty")
+	}
+	if _, err := time.LoadLocation(c.DeviceTimezone); err != nil {
+		return fmt.Errorf("device_timezone: %w", err)
+	}
+	for _, name := range c.Collectors {
+		if !slices.Contains(knownCollectors, name) {
+			return fmt.Errorf("unknown collector %s, expected one of %s", name, strings.Join(knownCollectors, ", "))
+		}
+	}
+
+	// a single device may be left unnamed, its series then have no device labels
+	names := map[string]bool{}
+	for i, d := range c.Devices {
+		if d.Name == "" && len(c.Devices) > 1 {
+			return fmt.Errorf("device %d has no name", i)
+		}
+		if d.URL == "" {
+			return fmt.Errorf("device %d has no url", i)
+		}
+		if _, err := getURL(d.URL); err != nil {
+			return fmt.Errorf("device %d: %w", i, err)
+		}
+		if d.Cells != 0 && (d.Cells < minCells || d.Cells > maxCells) {
+			return fmt.Errorf("device %d: cells must be between %d and %d, not %d", i, minCells, maxCells, d.Cells)
+		}
+		if names[d.Name] {
+			return fmt.Errorf("device %s is configured more than once", d.Name)
+		}
+		names[d.Name] = true
+	}
+	return nil
+}
+
+// parseConfig reads a config file over the defaults, rejecting unknown keys
+func parseConfig(config *Config, b []byte) error {
+	decoder := yaml.NewDecoder(bytes.NewReader(b))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// loadConfig builds the config from, in order of precedence, the command line flags,
+// the environment, the config file and the defaults. checkOnly is set by --check-config.
+func loadConfig(args []string, getenv func(string) string) (config *Config, checkOnly bool, err error) {
+	fs := flag.NewFlagSet("sbms_exporter", flag.ContinueOnError)
+	configFile := fs.String("config.file", "", "path of the YAML config file (env CONFIG_FILE)")
+	listenAddress := fs.String("web.listen-address", "", "address to serve metrics on (env LISTEN_ADDRESS)")
+	deviceURL := fs.String("url", "", "poll this single device instead of the devices in the config file (env URL)")
+	pollInterval := fs.Duration("poll-interval", 0, "how often the devices are polled (env POLL_INTERVAL)")
+	timeout := fs.Duration("timeout", 0, "timeout of each request to a device (env TIMEOUT)")
+	metricPrefix := fs.String("metric-prefix", "", "prefix of every metric name (env METRIC_PREFIX)")
+	deviceTimezone := fs.String("device-timezone", "", "IANA timezone the clocks of the devices are set to (env DEVICE_TIMEZONE)")
+	logLevel := fs.String("log.level", "", "debug, info, warn or error (env LOG_LEVEL)")
+	logFormat := fs.String("log.format", "", "text or json (env LOG_FORMAT)")
+	statePath := fs.String("state.path", "", "file the energy totals are kept in across restarts (env STATE_PATH)")
+	checkConfig := fs.Bool("check-config", false, "validate the config and exit")
+	if err := fs.Parse(args); err != nil {
+		return nil, false, err
+	}
+
+	env := map[string]string{}
+	for _, name := range []string{"CONFIG_FILE", "DEVICES_CONFIG", "LISTEN_ADDRESS", "URL", "POLL_INTERVAL", "TIMEOUT", "METRIC_PREFIX", "DEVICE_TIMEZONE", "ENABLE_DEFAULT_COLLECTORS", "LOG_LEVEL", "LOG_FORMAT", "STATE_PATH"} {
+		env[name] = getenv(name)
+	}
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	config = defaultConfig()
+
+	// DEVICES_CONFIG is the name CONFIG_FILE had when the file only listed devices
+	path := firstNonEmpty(*configFile, env["CONFIG_FILE"], env["DEVICES_CONFIG"])
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, false, err
+		}
+		if err := parseConfig(config, b); err != nil {
+			return nil, false, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	if v := firstNonEmpty(*listenAddress, env["LISTEN_ADDRESS"]); v != "" {
+		config.ListenAddress = v
+	}
+	if v := firstNonEmpty(*metricPrefix, env["METRIC_PREFIX"]); v != "" {
+		config.MetricPrefix = v
+	}
+	if v := firstNonEmpty(*deviceTimezone, env["DEVICE_TIMEZONE"]); v != "" {
+		config.DeviceTimezone = v
+	}
+	if v := firstNonEmpty(*logLevel, env["LOG_LEVEL"]); v != "" {
+		config.Log.Level = v
+	}
+	if v := firstNonEmpty(*logFormat, env["LOG_FORMAT"]); v != "" {
+		config.Log.Format = v
+	}
+	if v := firstNonEmpty(*statePath, env["STATE_PATH"]); v != "" {
+		config.State.Path = v
+	}
+	if v := firstNonEmpty(*deviceURL, env["URL"]); v != "" {
+		config.Devices = []DeviceConfig{{URL: v}}
+	}
+	if set["poll-interval"] {
+		config.PollInterval = *pollInterval
+	} else if env["POLL_INTERVAL"] != "" {
+		if config.PollInterval, err = time.ParseDuration(env["POLL_INTERVAL"]); err != nil {
+			return nil, false, fmt.Errorf("POLL_INTERVAL: %w", err)
+		}
+	}
+	if set["timeout"] {
+		config.Client.Timeout = *timeout
+	} else if env["TIMEOUT"] != "" {
+		if config.Client.Timeout, err = time.ParseDuration(env["TIMEOUT"]); err != nil {
+			return nil, false, fmt.Errorf("TIMEOUT: %w", err)
+		}
+	}
+	if isTrue(env["ENABLE_DEFAULT_COLLECTORS"]) {
+		for _, name := range []string{collectorGo, collectorProcess} {
+			if !config.collectorEnabled(name) {
+				config.Collectors = append(config.Collectors, name)
+			}
+		}
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, false, err
+	}
+	return config, *checkConfig, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func isTrue(v string) bool {
+	return slices.Contains([]string{"t", "1", "true", "yes"}, strings.ToLower(strings.TrimSpace(v)))
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func env(values map[string]string) func(string) string {
+	return func(name string) string {
+		return values[name]
+	}
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	config, checkOnly, err := loadConfig(nil, env(nil))
+	assert.Nil(t, err)
+	assert.False(t, checkOnly)
+	assert.Equal(t, defaultConfig(), config)
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	path := writeConfig(t, `
+listen_address: ":9100"
+poll_interval: 30s
+timeout: 2s
+metric_prefix: solar
+device_timezone: Europe/Berlin
+collectors: [rawdata]
+sinks:
+  prometheus:
+    path: /sbms
+devices:
+  - name: shed
+    url: 192.168.1.10
+    site: home
+    battery_bank: a
+  - name: boat
+    url: http://192.168.1.11
+`)
+	config, _, err := loadConfig([]string{"--config.file", path}, env(nil))
+	assert.Nil(t, err)
+	assert.Equal(t, &Config{
+		ListenAddress:  ":9100",
+		PollInterval:   30 * time.Second,
+		Client:         ClientConfig{Timeout: 2 * time.Second, Retries: defaultRetries, RetryBackoff: defaultRetryBackoff, BreakerFailures: defaultBreakerFailures, BreakerCooldown: defaultBreakerCooldown},
+		MetricPrefix:   "solar",
+		DeviceTimezone: "Europe/Berlin",
+		Collectors:     []string{collectorRawData},
+		Sinks: SinksConfig{
+			Prometheus: PrometheusSinkConfig{Enabled: true, Path: "/sbms", SystemPath: "/metrics_system"},
+			MQTT:       defaultMQTTSinkConfig(),
+			InfluxDB:   defaultInfluxDBSinkConfig(),
+			OTLP:       defaultOTLPSinkConfig(),
+		},
+		Devices: []DeviceConfig{
+			{Name: "shed", URL: "192.168.1.10", Site: "home", BatteryBank: "a"},
+			{Name: "boat", URL: "http://192.168.1.11"},
+		},
+		Log:   defaultLogConfig(),
+		State: defaultStateConfig(),
+	}, config)
+}
+
+func TestLoadConfigOverrides(t *testing.T) {
+	path := writeConfig(t, `
+listen_address: ":9100"
+poll_interval: 30s
+timeout: 2s
+devices:
+  - name: shed
+    url: 192.168.1.10
+`)
+	config, checkOnly, err := loadConfig(
+		[]string{"--web.listen-address", ":9200", "--timeout", "1s", "--check-config"},
+		env(map[string]string{
+			"CONFIG_FILE":               path,
+			"LISTEN_ADDRESS":            ":9300",
+			"POLL_INTERVAL":             "1m",
+			"TIMEOUT":                   "3s",
+			"URL":                       "192.168.1.20",
+			"DEVICE_TIMEZONE":           "Australia/Perth",
+			"ENABLE_DEFAULT_COLLECTORS": "true",
+		}))
+	assert.Nil(t, err)
+	assert.True(t, checkOnly)
+	// flags win over the environment, which wins over the file
+	assert.Equal(t, ":9200", config.ListenAddress)
+	assert.Equal(t, time.Second, config.Client.Timeout)
+	assert.Equal(t, time.Minute, config.PollInterval)
+	assert.Equal(t, "Australia/Perth", config.DeviceTimezone)
+	assert.Equal(t, []DeviceConfig{{URL: "192.168.1.20"}}, config.Devices)
+	assert.Equal(t, []string{collectorRawData, collectorSystem, collectorGo, collectorProcess}, config.Collectors)
+}
+
+func TestLoadConfigDevicesConfig(t *testing.T) {
+	path := writeConfig(t, "devices:\n  - name: shed\n    url: 192.168.1.10\n")
+	config, _, err := loadConfig(nil, env(map[string]string{"DEVICES_CONFIG": path}))
+	assert.Nil(t, err)
+	assert.Equal(t, []DeviceConfig{{Name: "shed", URL: "192.168.1.10"}}, config.Devices)
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	cases := map[string]string{
+		"not yaml":          "devices: [",
+		"unknown key":       "listen: :9000\n",
+		"bad duration":      "poll_interval: often\n",
+		"zero timeout":      "timeout: 0s\n",
+		"negative retries":  "retries: -1\n",
+		"zero breaker":      "breaker_failures: 0\n",
+		"empty prefix":      "metric_prefix: \"\"\n",
+		"unknown collector": "collectors: [rawdata, nope]\n",
+		"device timezone":   "device_timezone: Mars/Olympus\n",
+		"no name":           "devices:\n  - url: a\n  - name: b\n    url: b\n",
+		"no url":            "devices:\n  - name: shed\n",
+		"duplicate":         "devices:\n  - name: shed\n    url: a\n  - name: shed\n    url: b\n",
+		"cells":             "devices:\n  - name: shed\n    url: a\n    cells: 9\n",
+		"log level":         "log:\n  level: loud\n",
+		"log format":        "log:\n  format: xml\n",
+		"save interval":     "state:\n  save_interval: 0s\n",
+		"mqtt broker":       "sinks:\n  mqtt:\n    enabled: true\n",
+		"influxdb url":      "sinks:\n  influxdb:\n    enabled: true\n    url: ftp://localhost\n",
+		"influxdb bucket":   "sinks:\n  influxdb:\n    enabled: true\n    url: http://localhost:8086\n",
+		"otlp protocol":     "sinks:\n  otlp:\n    enabled: true\n    protocol: thrift\n",
+		"mqtt qos":          "sinks:\n  mqtt:\n    enabled: true\n    broker: tcp://localhost:1883\n    qos: 3\n",
+	}
+	for name, c := range cases {
+		_, _, err := loadConfig([]string{"--config.file", writeConfig(t, c)}, env(nil))
+		assert.NotNil(t, err, name)
+	}
+
+	_, _, err := loadConfig(nil, env(map[string]string{"POLL_INTERVAL": "often"}))
+	assert.NotNil(t, err)
+	_, _, err = loadConfig([]string{"--config.file", "does-not-exist.yaml"}, env(nil))
+	assert.NotNil(t, err)
+}
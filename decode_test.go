@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestDecodeMissingVariable(t *testing.T) {
+	content := strings.Replace(string(readFileContent(t, "./__source__/rawData6")), "var xsbms=", "var notxsbms=", 1)
+	_, err := Decode([]byte(content))
+	var missing *MissingVariableError
+	if assert.True(t, errors.As(err, &missing)) {
+		assert.Equal(t, "xsbms", missing.Name)
+	}
+}
+
+func TestDecodeShortField(t *testing.T) {
+	content := strings.Replace(string(readFileContent(t, "./__source__/rawData6")), `var sbms=";%70C[`, `var sbms=";%70C["; var unused="`, 1)
+	_, err := Decode([]byte(content))
+	var short *ShortFieldError
+	if assert.True(t, errors.As(err, &short)) {
+		assert.Equal(t, ShortFieldError{Name: "sbms", Length: 6, Want: 59}, *short)
+	}
+
+	content = strings.Replace(string(readFileContent(t, "./__source__/rawData6")), "var s2=[0,0,0,0,0,0,0,0,2,7,1,1]", "var s2=[0,0,0]", 1)
+	_, err = Decode([]byte(content))
+	if assert.True(t, errors.As(err, &short)) {
+		assert.Equal(t, ShortFieldError{Name: "s2", Length: 3, Want: 8}, *short)
+	}
+}
+
+func TestDecodeBadEscape(t *testing.T) {
+	content := strings.Replace(string(readFileContent(t, "./__source__/rawData6")), `var eA="##`, `var eA="\x#`, 1)
+	_, err := Decode([]byte(content))
+	var escape *EscapeError
+	assert.True(t, errors.As(err, &escape))
+}
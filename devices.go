@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// DeviceConfig is one SBMS0 to poll
+type DeviceConfig struct {
+	Name        string `yaml:"name"`
+	URL         string `yaml:"url"`
+	Site        string `yaml:"site"`
+	BatteryBank string `yaml:"battery_bank"`
+	// Cells is the number of cells of the battery, which are exported even before they
+	// were seen; it's detected when left at zero
+	Cells int `yaml:"cells"`
+}
+
+// labels are added to every series of the device, so devices don't overwrite each other;
+// an unnamed device has none
+func (d DeviceConfig) labels() prometheus.Labels {
+	if d.Name == "" {
+		return nil
+	}
+	return prometheus.Labels{
+		"device":       d.Name,
+		"site":         d.Site,
+		"battery_bank": d.BatteryBank,
+	}
+}
+
+// energyKey identifies the energy registers of the device, by its name or its url if it has none
+func (d DeviceConfig) energyKey() string {
+	if d.Name == "" {
+		return d.URL
+	}
+	return d.Name
+}
+
+// id names the device in mqtt topics and api paths: its name, or the host of its url if it has none
+func (d DeviceConfig) id() string {
+	if d.Name != "" {
+		return d.Name
+	}
+	if u, err := parseRawURL(d.URL); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return d.URL
+}
+
+// pollerKey is everything that decides how a device is polled, and which device it is;
+// a device whose key didn't change keeps its pollers, and their state, across a reload
+type pollerKey struct {
+	// energy is the energyKey of the device, so each device has pollers of its own
+	energy   string
+	url      string
+	cells    int
+	interval time.Duration
+	client   ClientConfig
+	rawData  bool
+	system   bool
+}
+
+func newPollerKey(config *Config, device DeviceConfig) pollerKey {
+	return pollerKey{
+		energy:   device.energyKey(),
+		url:      device.URL,
+		cells:    device.Cells,
+		interval: config.PollInterval,
+		client:   config.Client,
+		rawData:  config.collectorEnabled(collectorRawData),
+		system:   config.collectorEnabled(collectorSystem),
+	}
+}
+
+// devicePollers poll the rawData and debug endpoints of one device through one client,
+// so they share its circuit breaker; a poller is nil if its collector isn't enabled.
+type devicePollers struct {
+	client *DeviceClient
+	// cells is the most cells seen on the battery; a cell is never dropped once it was
+	// seen, so a failing last cell keeps its series rather than disappearing
+	cells   atomic.Int64
+	rawData *Poller[*SBMSData]
+	system  *Poller[[]SystemTaskInfo]
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// publisher hands the polls of the device with key to the sinks of the current config;
+// every rawData updates the energy counters of the device first, so that no reset is
+// missed between scrapes
+type publisher interface {
+	publishRawData(key pollerKey, data *SBMSData)
+	publishSystemTasks(key pollerKey, tasks []SystemTaskInfo)
+}
+
+func newDevicePollers(key pollerKey, flights *flightGroup, publisher publisher, logger *slog.Logger) (*devicePollers, error) {
+	pollers := &devicePollers{client: NewDeviceClient(key.client, flights)}
+	pollers.cells.Store(int64(key.cells))
+	if key.rawData {
+		u, err := getURL(key.url)
+		if err != nil {
+			return nil, err
+		}
+		pollers.rawData = NewPoller(u, key.interval, pollers.client, logger, func(b []byte) (*SBMSData, error) {
+			data, err := decodeRawDataCells(b, logger, int(pollers.cells.Load()))
+			if err == nil {
+				pollers.cells.Store(int64(len(data.cells)))
+			}
+			return data, err
+		})
+		pollers.rawData.onSuccess = func(data *SBMSData) { publisher.publishRawData(key, data) }
+	}
+	if key.system {
+		u, err := getDebugURL(key.url)
+		if err != nil {
+			return nil, err
+		}
+		pollers.system = NewPoller(u, key.interval, pollers.client, logger, decodeDebug)
+		pollers.system.onSuccess = func(tasks []SystemTaskInfo) { publisher.publishSystemTasks(key, tasks) }
+	}
+	return pollers, nil
+}
+
+// start polls in the background until stop is called
+func (d *devicePollers) start() {
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	if d.rawData != nil {
+		go d.rawData.Run(d.ctx)
+	}
+	if d.system != nil {
+		go d.system.Run(d.ctx)
+	}
+}
+
+func (d *devicePollers) stop() {
+	if d.cancel != nil {
+		d.cancel()
+	}
+}
+
+// register adds the collectors of the device, with its energy counters, to the registries
+func (d *devicePollers) register(reg, systemMetricsReg prometheus.Registerer, energy *energyTracker, prefix string, labels prometheus.Labels) error {
+	if d.rawData != nil {
+		if err := reg.Register(NewSBMS0Collector(d.rawData, energy, prefix, labels)); err != nil {
+			return err
+		}
+	}
+	if d.system != nil {
+		if err := systemMetricsReg.Register(NewSBMS0SystemCollector(d.system, prefix, labels)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
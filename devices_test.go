@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDeviceLabels(t *testing.T) {
+	assert.Equal(t, prometheus.Labels{"device": "shed", "site": "home", "battery_bank": "a"}, DeviceConfig{Name: "shed", Site: "home", BatteryBank: "a"}.labels())
+	assert.Nil(t, DeviceConfig{URL: "192.168.1.10"}.labels())
+}
+
+func TestCollectTwoDevices(t *testing.T) {
+	shed := serveContent(readFileContent(t, "./__source__/rawData6"), http.StatusOK)
+	defer shed.Close()
+	boat := serveContent(readFileContent(t, "./__source__/rawData15"), http.StatusOK)
+	defer boat.Close()
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(
+		NewSBMS0Collector(polledOnce(shed.URL, Decode), newEnergyTracker(), defaultMetricPrefix, DeviceConfig{Name: "shed", Site: "home", BatteryBank: "a"}.labels()),
+		NewSBMS0Collector(polledOnce(boat.URL, Decode), newEnergyTracker(), defaultMetricPrefix, DeviceConfig{Name: "boat", Site: "marina", BatteryBank: "b"}.labels()),
+	)
+
+	expected := `
+# HELP sbms_cell_count Number of cells detected in the battery
+# TYPE sbms_cell_count gauge
+sbms_cell_count{battery_bank="a",device="shed",site="home"} 8
+sbms_cell_count{battery_bank="b",device="boat",site="marina"} 4
+# HELP sbms_up Whether the last scrape of the SBMS0 succeeded
+# TYPE sbms_up gauge
+sbms_up{battery_bank="a",device="shed",site="home"} 1
+sbms_up{battery_bank="b",device="boat",site="marina"} 1
+`
+	err := testutil.GatherAndCompare(reg, strings.NewReader(expected), "sbms_cell_count", "sbms_up")
+	assert.Nil(t, err)
+}
+
+// nopPublisher drops the polls of the devices
+type nopPublisher struct{}
+
+func (nopPublisher) publishRawData(pollerKey, *SBMSData)            {}
+func (nopPublisher) publishSystemTasks(pollerKey, []SystemTaskInfo) {}
+
+func TestDevicePollersKeepSeenCells(t *testing.T) {
+	healthy := readFileContent(t, "./__source__/rawData6")
+	// cell 8 of the 8S pack of rawData6 reads nothing, as with an open wire
+	dead := []byte(strings.Replace(string(healthy), "GEGHGGGFGEGCGBGC", "GEGHGGGFGEGCGB##", 1))
+	out, err := Decode(dead)
+	assert.Nil(t, err)
+	assert.Len(t, out.cells, 7)
+
+	var content atomic.Value
+	content.Store(healthy)
+	device := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(content.Load().([]byte))
+	}))
+	defer device.Close()
+
+	key := pollerKey{energy: "shed", url: device.URL, interval: time.Hour, client: testClientConfig(), rawData: true}
+	pollers, err := newDevicePollers(key, nil, nopPublisher{}, slog.Default())
+	assert.Nil(t, err)
+	pollers.rawData.Poll(context.Background())
+	assert.Len(t, pollers.rawData.Result().Latest.cells, 8)
+
+	content.Store(dead)
+	pollers.rawData.Poll(context.Background())
+	cells := pollers.rawData.Result().Latest.cells
+	if assert.Len(t, cells, 8) {
+		assert.Equal(t, 0, cells[7].mV)
+	}
+
+	// a configured cell count holds from the first poll
+	key.cells = 8
+	pollers, err = newDevicePollers(key, nil, nopPublisher{}, slog.Default())
+	assert.Nil(t, err)
+	pollers.rawData.Poll(context.Background())
+	assert.Len(t, pollers.rawData.Result().Latest.cells, 8)
+}
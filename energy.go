@@ -0,0 +1,162 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+)
+
+// energyCounter is one of the cumulative energy registers of the SBMS0, exported as a counter
+type energyCounter struct {
+	name  string
+	help  string
+	value func(d *SBMSData) float64
+	has   func(d *SBMSData) bool
+}
+
+var energyCounters = []energyCounter{
+	{name: "battery_wh", help: "Energy through the battery, in Wh", value: func(d *SBMSData) float64 { return d.batteryEnergyWh }},
+	{name: "battery_ah", help: "Charge through the battery, in Ah", value: func(d *SBMSData) float64 { return d.batteryEnergyAh }},
+	{name: "pv1_wh", help: "Energy from PV1, in Wh", value: func(d *SBMSData) float64 { return d.pV1EnergyWh }},
+	{name: "pv1_ah", help: "Charge from PV1, in Ah", value: func(d *SBMSData) float64 { return d.pV1EnergyAh }},
+	{name: "pv2_wh", help: "Energy from PV2, in Wh", value: func(d *SBMSData) float64 { return d.pV2EnergyWh }, has: hasPV2},
+	{name: "pv2_ah", help: "Charge from PV2, in Ah", value: func(d *SBMSData) float64 { return d.pV2EnergyAh }, has: hasPV2},
+	{name: "dmppt_wh", help: "Energy from the DMPPT, in Wh", value: func(d *SBMSData) float64 { return d.dmpptEnergyWh }, has: hasDMPPTData},
+	{name: "dmppt_ah", help: "Charge from the DMPPT, in Ah", value: func(d *SBMSData) float64 { return d.dmpptEnergyAh }, has: hasDMPPTData},
+	{name: "load_wh", help: "Energy to the load, in Wh", value: func(d *SBMSData) float64 { return d.loadEnergyWh }},
+	{name: "load_ah", help: "Charge to the load, in Ah", value: func(d *SBMSData) float64 { return d.loadEnergyAh }},
+	{name: "ext_load_wh", help: "Energy to the external load, in Wh", value: func(d *SBMSData) float64 { return d.extLoadEnergyWh }, has: hasExtLoad},
+	{name: "ext_load_ah", help: "Charge to the external load, in Ah", value: func(d *SBMSData) float64 { return d.extLoadEnergyAh }, has: hasExtLoad},
+}
+
+// energyDescs describe the energy counters of one SBMS0
+type energyDescs struct {
+	totals   []*prometheus.Desc
+	resets   *prometheus.Desc
+	rejected *prometheus.Desc
+}
+
+func newEnergyDescs(prefix string, labels prometheus.Labels) energyDescs {
+	descs := energyDescs{
+		resets:   prometheus.NewDesc(prefix+"_energy_register_resets_total", "Number of times an energy register of the SBMS0 was reset", []string{"register"}, labels),
+		rejected: prometheus.NewDesc(prefix+"_energy_rejected_readings_total", "Number of energy register readings dropped as zero or backwards glitches", []string{"register"}, labels),
+	}
+	for _, c := range energyCounters {
+		descs.totals = append(descs.totals, prometheus.NewDesc(prometheus.BuildFQName(prefix, "energy", c.name+"_total"), c.help, nil, labels))
+	}
+	return descs
+}
+
+func (d energyDescs) describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range d.totals {
+		ch <- desc
+	}
+	ch <- d.resets
+	ch <- d.rejected
+}
+
+// energyRegister follows one register, adding up its readings across device resets
+type energyRegister struct {
+	last       float64
+	offset     float64
+	pending    float64
+	hasPending bool
+	resets     uint64
+	rejected   uint64
+}
+
+// total only goes up, unlike the register
+func (r *energyRegister) total() float64 {
+	return r.offset + r.last
+}
+
+// energyJumpFactor is how many times the last reading a reading may be before it's
+// held as a possible spike; a register only grows a little between polls
+const energyJumpFactor = 2
+
+// update takes a reading of the register. A zero reading is a glitch the SBMS0 is known
+// for; a reading below the last one is held until the next reading, which confirms a
+// reset if it doesn't go back up to the last reading, and shows a glitch otherwise.
+// Likewise a reading far above the last one is held until the next reading, which
+// confirms the jump if it stays above it, and shows a spike if it falls back.
+func (r *energyRegister) update(v float64) {
+	switch {
+	case v == 0 && r.last > 0:
+		r.rejected++
+	case r.hasPending && r.pending > r.last && v >= r.pending:
+		r.last = v
+		r.hasPending = false
+	case r.last > 0 && v > r.last*energyJumpFactor:
+		if r.hasPending {
+			r.rejected++
+		}
+		r.pending = v
+		r.hasPending = true
+	case v >= r.last:
+		if r.hasPending {
+			r.hasPending = false
+			r.rejected++
+		}
+		r.last = v
+	case r.hasPending && r.pending < r.last && v >= r.pending:
+		r.offset += r.last
+		r.last = v
+		r.hasPending = false
+		r.resets++
+	default:
+		if r.hasPending {
+			r.rejected++
+		}
+		r.pending = v
+		r.hasPending = true
+	}
+}
+
+// energyTracker keeps the energy totals of one device across polls
+type energyTracker struct {
+	mu        sync.Mutex
+	seen      *SBMSData
+	registers []energyRegister
+}
+
+func newEnergyTracker() *energyTracker {
+	return &energyTracker{registers: make([]energyRegister, len(energyCounters))}
+}
+
+// observe updates the registers with d, unless d was already observed
+func (t *energyTracker) observe(d *SBMSData) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if d == nil || d == t.seen {
+		return
+	}
+	t.seen = d
+	for i, c := range energyCounters {
+		t.registers[i].update(c.value(d))
+	}
+}
+
+// export sends the counters of the registers the model of d has
+func (t *energyTracker) export(ch chan<- prometheus.Metric, descs energyDescs, d *SBMSData) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, c := range energyCounters {
+		if c.has != nil && !c.has(d) {
+			continue
+		}
+		r := t.registers[i]
+		ch <- prometheus.MustNewConstMetric(descs.totals[i], prometheus.CounterValue, r.total())
+		ch <- prometheus.MustNewConstMetric(descs.resets, prometheus.CounterValue, float64(r.resets), c.name)
+		ch <- prometheus.MustNewConstMetric(descs.rejected, prometheus.CounterValue, float64(r.rejected), c.name)
+	}
+}
+
+// totals are the totals of the registers, in the order of energyCounters
+func (t *energyTracker) totals() []float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	totals := make([]float64, len(t.registers))
+	for i, r := range t.registers {
+		totals[i] = r.total()
+	}
+	return totals
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestEnergyRegister(t *testing.T) {
+	cases := map[string]struct {
+		readings []float64
+		total    float64
+		resets   uint64
+		rejected uint64
+	}{
+		"increasing":     {readings: []float64{10, 12, 15}, total: 15},
+		"zero glitch":    {readings: []float64{10, 0, 12}, total: 12, rejected: 1},
+		"backwards jump": {readings: []float64{10, 3, 12}, total: 12, rejected: 1},
+		"reset":          {readings: []float64{10, 1, 2}, total: 12, resets: 1},
+		"reset to zero":  {readings: []float64{10, 0, 0, 1, 1}, total: 11, resets: 1, rejected: 2},
+		"two resets":     {readings: []float64{10, 1, 4, 2, 3}, total: 17, resets: 2},
+		"pending glitch": {readings: []float64{10, 5, 3, 4}, total: 14, resets: 1, rejected: 1},
+		"never used":     {readings: []float64{0, 0}, total: 0},
+		"forward spike":  {readings: []float64{10, 1000000, 12}, total: 12, rejected: 1},
+		"spike to reset": {readings: []float64{10, 1000000, 1, 2}, total: 12, resets: 1, rejected: 1},
+		"forward jump":   {readings: []float64{10, 1000, 1001}, total: 1001},
+		"after a reset":  {readings: []float64{10, 1, 2, 5, 6}, total: 16, resets: 1},
+	}
+	for name, c := range cases {
+		var r energyRegister
+		for _, v := range c.readings {
+			r.update(v)
+		}
+		assert.Equal(t, c.total, r.total(), name)
+		assert.Equal(t, c.resets, r.resets, name)
+		assert.Equal(t, c.rejected, r.rejected, name)
+	}
+}
+
+func TestEnergyTrackerObservesOnce(t *testing.T) {
+	tracker := newEnergyTracker()
+	d := &SBMSData{batteryEnergyWh: 10}
+	tracker.observe(d)
+	tracker.observe(d)
+	tracker.observe(&SBMSData{batteryEnergyWh: 5})
+	tracker.observe(&SBMSData{batteryEnergyWh: 6})
+	assert.Equal(t, 16.0, tracker.registers[0].total())
+	assert.Equal(t, uint64(1), tracker.registers[0].resets)
+}
+
+func TestCollectEnergyCounters(t *testing.T) {
+	device := serveContent(readFileContent(t, "./__source__/rawData6"), http.StatusOK)
+	defer device.Close()
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewSBMS0Collector(polledOnce(device.URL, Decode), newEnergyTracker(), defaultMetricPrefix, nil))
+	err := testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP sbms_energy_battery_wh_total Energy through the battery, in Wh
+# TYPE sbms_energy_battery_wh_total counter
+sbms_energy_battery_wh_total 398056.7
+# HELP sbms_energy_pv1_ah_total Charge from PV1, in Ah
+# TYPE sbms_energy_pv1_ah_total counter
+sbms_energy_pv1_ah_total 26846.452
+`), "sbms_energy_battery_wh_total", "sbms_energy_pv1_ah_total")
+	assert.Nil(t, err)
+}
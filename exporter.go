@@ -0,0 +1,389 @@
+package main
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Exporter serves the devices of the current config. Reload builds the collectors
+// and handlers of a new config next to the running ones and swaps them in at once,
+// so a bad config leaves the exporter as it was.
+type Exporter struct {
+	load     func() (*Config, error)
+	flights  *flightGroup
+	logLevel *slog.LevelVar
+
+	// mu serialises reloads and saves of the state
+	mu      sync.Mutex
+	current atomic.Pointer[exporterInstance]
+	// state is the energy state last read or written, which new devices continue from
+	state     *energyState
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	reloadSuccess     atomic.Bool
+	reloadSuccessTime atomic.Int64
+}
+
+// exporterInstance is everything built from one config
+type exporterInstance struct {
+	config  *Config
+	pollers map[pollerKey]*devicePollers
+	// energy is kept by device, so the energy totals survive a device being polled differently
+	energy map[string]*energyTracker
+	// devices are the devices polled by each of pollers, to tell the sinks which device a poll is of
+	devices map[pollerKey]DeviceConfig
+	sinks   map[string]runningSink
+	handler http.Handler
+}
+
+// NewExporter loads the first config with load, and reloads with it later;
+// the log level of each config is set on logLevel. The energy state is read
+// from the state path of the first config, and saved to that of the current one.
+func NewExporter(load func() (*Config, error), logLevel *slog.LevelVar) (*Exporter, error) {
+	e := &Exporter{load: load, flights: newFlightGroup(), logLevel: logLevel, closed: make(chan struct{})}
+	config, err := load()
+	if err != nil {
+		return nil, err
+	}
+	if config.State.Path != "" {
+		if e.state, err = loadEnergyState(config.State.Path); err != nil {
+			return nil, err
+		}
+	}
+	if err := e.apply(config); err != nil {
+		return nil, err
+	}
+	go e.runStateSaver()
+	return e, nil
+}
+
+// Config is the config currently in use
+func (e *Exporter) Config() *Config {
+	return e.current.Load().config
+}
+
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.current.Load().handler.ServeHTTP(w, r)
+}
+
+// Close stops polling the devices, saves the energy state and closes the sinks. The state
+// is saved first, as the sinks may take a while to flush, longer than a container is
+// given to stop.
+func (e *Exporter) Close() {
+	e.closeOnce.Do(func() {
+		close(e.closed)
+		current := e.current.Load()
+		for _, pollers := range current.pollers {
+			pollers.stop()
+		}
+		e.saveState()
+		closeSinks(current.sinks, nil)
+	})
+}
+
+// runStateSaver saves the energy state on every save interval until Close
+func (e *Exporter) runStateSaver() {
+	for {
+		select {
+		case <-e.closed:
+			return
+		case <-time.After(e.Config().State.SaveInterval):
+			e.saveState()
+		}
+	}
+}
+
+// saveState writes the energy totals of the current devices, and keeps those of
+// removed devices, to the state path; without one nothing is saved
+func (e *Exporter) saveState() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	current := e.current.Load()
+	if current.config.State.Path == "" {
+		return
+	}
+	if e.state == nil {
+		e.state = &energyState{Devices: map[string]map[string]energyRegisterState{}}
+	}
+	for key, energy := range current.energy {
+		e.state.Devices[key] = energy.state()
+	}
+	if err := e.state.save(current.config.State.Path); err != nil {
+		slog.Warn("could not save state", "path", current.config.State.Path, "err", err)
+	}
+}
+
+// Reload reads the config again and applies it, or keeps the running one if that fails
+func (e *Exporter) Reload() error {
+	config, err := e.load()
+	if err == nil {
+		err = e.apply(config)
+	}
+	if err != nil {
+		e.reloadSuccess.Store(false)
+		slog.Error("could not reload config", "err", err)
+		return err
+	}
+	slog.Info("reloaded config")
+	return nil
+}
+
+func (e *Exporter) apply(config *Config) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	previous := e.current.Load()
+	next, err := e.build(config, previous)
+	if err != nil {
+		e.reloadSuccess.Store(false)
+		return err
+	}
+	if previous != nil && previous.config.ListenAddress != config.ListenAddress {
+		slog.Warn("listen_address changed, which needs a restart", "listen_address", config.ListenAddress)
+	}
+	if previous != nil && previous.config.Log.Format != config.Log.Format {
+		slog.Warn("log format changed, which needs a restart", "format", config.Log.Format)
+	}
+	if level, err := config.Log.level(); err == nil {
+		e.logLevel.Set(level)
+	}
+
+	// next is current before its new pollers start, so their first polls find their device
+	e.current.Store(next)
+	for key, pollers := range next.pollers {
+		if previous == nil || previous.pollers[key] != pollers {
+			pollers.start()
+		}
+	}
+	if previous != nil {
+		for key, pollers := range previous.pollers {
+			if next.pollers[key] != pollers {
+				pollers.stop()
+			}
+		}
+		closeSinks(previous.sinks, next.sinks)
+	}
+
+	e.reloadSuccess.Store(true)
+	e.reloadSuccessTime.Store(time.Now().Unix())
+	return nil
+}
+
+// build creates the registries and handlers of config, reusing the pollers of previous
+// for devices that are polled the same way; nothing is started yet
+func (e *Exporter) build(config *Config, previous *exporterInstance) (*exporterInstance, error) {
+	next := &exporterInstance{
+		config:  config,
+		pollers: map[pollerKey]*devicePollers{},
+		energy:  map[string]*energyTracker{},
+		devices: map[pollerKey]DeviceConfig{},
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	systemMetricsReg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(exporterCollector{exporter: e, descs: newExporterDescs(config.MetricPrefix)})
+	if config.collectorEnabled(collectorProcess) {
+		reg.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	}
+	if config.collectorEnabled(collectorGo) {
+		reg.MustRegister(collectors.NewGoCollector())
+	}
+
+	mux := http.NewServeMux()
+	api := APIHandler{devices: map[string]*devicePollers{}, histories: map[string]HistoryHandler{}, location: config.deviceLocation()}
+
+	// without devices the exporter only serves /probe
+	for _, d := range config.Devices {
+		energy, ok := next.energy[d.energyKey()]
+		if !ok && previous != nil {
+			energy, ok = previous.energy[d.energyKey()]
+		}
+		if !ok && previous != nil {
+			energy, ok = renamedEnergy(config, previous, d)
+		}
+		if !ok {
+			energy = newEnergyTracker()
+			if e.state != nil {
+				energy.restore(e.state.Devices[d.energyKey()])
+			}
+		}
+		next.energy[d.energyKey()] = energy
+
+		key := newPollerKey(config, d)
+		pollers, ok := next.pollers[key]
+		if !ok && previous != nil {
+			pollers, ok = previous.pollers[key]
+		}
+		logger := deviceLogger(slog.Default(), d.Name, d.URL)
+		if !ok {
+			var err error
+			if pollers, err = newDevicePollers(key, e.flights, e, logger); err != nil {
+				return nil, fmt.Errorf("device %s: %w", d.URL, err)
+			}
+		}
+		next.pollers[key] = pollers
+		api.devices[d.id()] = pollers
+		if _, ok := next.devices[key]; !ok {
+			next.devices[key] = d
+		}
+
+		if err := pollers.register(reg, systemMetricsReg, energy, config.MetricPrefix, d.labels()); err != nil {
+			return nil, fmt.Errorf("device %s: %w", d.URL, err)
+		}
+		u, err := getURL(d.URL)
+		if err != nil {
+			return nil, err
+		}
+		history := HistoryHandler{url: u, client: pollers.client, location: config.deviceLocation(), logger: logger}
+		api.histories[d.id()] = history
+		// the path from before there were many devices
+		if len(config.Devices) == 1 {
+			mux.Handle("/api/history", history)
+		}
+	}
+
+	if config.Sinks.Prometheus.Enabled {
+		handler := promhttp.InstrumentMetricHandler(reg, promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+		systemMetricsHandler := promhttp.InstrumentMetricHandler(systemMetricsReg, promhttp.HandlerFor(systemMetricsReg, promhttp.HandlerOpts{}))
+
+		mux.Handle(config.Sinks.Prometheus.Path, handler)
+		mux.Handle(config.Sinks.Prometheus.SystemPath, systemMetricsHandler)
+	}
+	mux.Handle(apiDevicesPath, api)
+	mux.HandleFunc("/api/v1/schema.json", serveAPISchema)
+	mux.Handle("/probe", ProbeHandler{prefix: config.MetricPrefix, client: config.Client, flights: e.flights})
+	mux.HandleFunc("/-/reload", e.serveReload)
+	next.handler = mux
+
+	// sinks are created last, so that nothing else can fail after they connect
+	var previousSinks map[string]runningSink
+	if previous != nil {
+		previousSinks = previous.sinks
+	}
+	var err error
+	if next.sinks, err = newSinks(config, previousSinks, e); err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+// energy is the energy tracker of device in the current config, as sinks outlive reloads
+func (e *Exporter) energy(device DeviceConfig) *energyTracker {
+	current := e.current.Load()
+	if current == nil {
+		return nil
+	}
+	return current.energy[device.energyKey()]
+}
+
+// rawDataResult is the latest rawData poll of device in the current config
+func (e *Exporter) rawDataResult(device DeviceConfig) (PollResult[*SBMSData], bool) {
+	current := e.current.Load()
+	if current == nil {
+		return PollResult[*SBMSData]{}, false
+	}
+	pollers, ok := current.pollers[newPollerKey(current.config, device)]
+	if !ok || pollers.rawData == nil {
+		return PollResult[*SBMSData]{}, false
+	}
+	return pollers.rawData.Result(), true
+}
+
+// renamedEnergy is the energy tracker of a device of previous at the url of d that
+// config no longer has, so a renamed device carries on from its totals
+func renamedEnergy(config *Config, previous *exporterInstance, d DeviceConfig) (*energyTracker, bool) {
+	configured := map[string]bool{}
+	for _, device := range config.Devices {
+		configured[device.energyKey()] = true
+	}
+	for _, old := range previous.devices {
+		if old.URL == d.URL && !configured[old.energyKey()] {
+			energy, ok := previous.energy[old.energyKey()]
+			return energy, ok
+		}
+	}
+	return nil, false
+}
+
+// publishRawData observes data with the energy tracker of the current config for the
+// device, so a device keeps its totals however its pollers were reused, and publishes it
+func (e *Exporter) publishRawData(key pollerKey, data *SBMSData) {
+	current := e.current.Load()
+	if current == nil {
+		return
+	}
+	if device, ok := current.devices[key]; ok {
+		if energy, ok := current.energy[device.energyKey()]; ok {
+			energy.observe(data)
+		}
+		for _, s := range current.sinks {
+			s.sink.PublishRawData(device, data)
+		}
+	}
+}
+
+func (e *Exporter) publishSystemTasks(key pollerKey, tasks []SystemTaskInfo) {
+	current := e.current.Load()
+	if current == nil {
+		return
+	}
+	if device, ok := current.devices[key]; ok {
+		for _, s := range current.sinks {
+			s.sink.PublishSystemTasks(device, tasks)
+		}
+	}
+}
+
+// serveReload reloads the config on POST /-/reload
+func (e *Exporter) serveReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := e.Reload(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+type exporterDescs struct {
+	reloadSuccess       *prometheus.Desc
+	reloadSuccessTime   *prometheus.Desc
+	deduplicatedFetches *prometheus.Desc
+}
+
+func newExporterDescs(prefix string) exporterDescs {
+	return exporterDescs{
+		reloadSuccess:       prometheus.NewDesc(prefix+"_exporter_config_last_reload_success", "Whether the last config reload succeeded", nil, nil),
+		reloadSuccessTime:   prometheus.NewDesc(prefix+"_exporter_config_last_reload_success_timestamp_seconds", "Time of the last successful config reload", nil, nil),
+		deduplicatedFetches: prometheus.NewDesc(prefix+"_exporter_deduplicated_requests_total", "Number of requests to a device that waited for one already in flight", nil, nil),
+	}
+}
+
+// exporterCollector exports the state of an Exporter, which outlives reloads
+type exporterCollector struct {
+	exporter *Exporter
+	descs    exporterDescs
+}
+
+func (c exporterCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.descs.reloadSuccess
+	ch <- c.descs.reloadSuccessTime
+	ch <- c.descs.deduplicatedFetches
+}
+
+func (c exporterCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(c.descs.reloadSuccess, prometheus.GaugeValue, boolToFloat(c.exporter.reloadSuccess.Load()))
+	ch <- prometheus.MustNewConstMetric(c.descs.reloadSuccessTime, prometheus.GaugeValue, float64(c.exporter.reloadSuccessTime.Load()))
+	ch <- prometheus.MustNewConstMetric(c.descs.deduplicatedFetches, prometheus.CounterValue, float64(c.exporter.flights.deduplicated.Load()))
+}
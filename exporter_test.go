@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testExporter returns an exporter that loads *config on every reload
+func testExporter(t *testing.T, config **Config, err *error) *Exporter {
+	exporter, e := NewExporter(func() (*Config, error) {
+		if *err != nil {
+			return nil, *err
+		}
+		return *config, nil
+	}, new(slog.LevelVar))
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Cleanup(exporter.Close)
+	return exporter
+}
+
+func get(handler http.Handler, method, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+	return rec
+}
+
+func configWithDevices(devices ...DeviceConfig) *Config {
+	config := defaultConfig()
+	config.PollInterval = time.Hour
+	config.Devices = devices
+	return config
+}
+
+func TestExporterReloadAddsDevice(t *testing.T) {
+	device := serveContent(readFileContent(t, "./__source__/rawData6"), http.StatusOK)
+	defer device.Close()
+
+	shed := DeviceConfig{Name: "shed", URL: device.URL}
+	config := configWithDevices(shed)
+	var loadErr error
+	exporter := testExporter(t, &config, &loadErr)
+	shedPollers := exporter.current.Load().pollers[newPollerKey(config, shed)]
+
+	body := get(exporter, http.MethodGet, "/metrics").Body.String()
+	assert.Contains(t, body, `device="shed"`)
+	assert.NotContains(t, body, `device="boat"`)
+	assert.Contains(t, body, "sbms_exporter_config_last_reload_success 1")
+
+	config = configWithDevices(shed, DeviceConfig{Name: "boat", URL: device.URL + "/boat"})
+	assert.Equal(t, http.StatusOK, get(exporter, http.MethodPost, "/-/reload").Code)
+
+	body = get(exporter, http.MethodGet, "/metrics").Body.String()
+	assert.Contains(t, body, `device="shed"`)
+	assert.Contains(t, body, `device="boat"`)
+	// the unchanged device keeps polling with the same poller
+	assert.Same(t, shedPollers, exporter.current.Load().pollers[newPollerKey(config, shed)])
+}
+
+func TestExporterReloadFailureKeepsConfig(t *testing.T) {
+	config := configWithDevices(DeviceConfig{Name: "shed", URL: "127.0.0.1:1"})
+	var loadErr error
+	exporter := testExporter(t, &config, &loadErr)
+	running := exporter.Config()
+
+	loadErr = errors.New("bad config")
+	assert.Equal(t, http.StatusInternalServerError, get(exporter, http.MethodPost, "/-/reload").Code)
+	assert.Same(t, running, exporter.Config())
+
+	body := get(exporter, http.MethodGet, "/metrics").Body.String()
+	assert.Contains(t, body, `device="shed"`)
+	assert.Contains(t, body, "sbms_exporter_config_last_reload_success 0")
+
+	loadErr = nil
+	assert.Nil(t, exporter.Reload())
+	assert.Contains(t, get(exporter, http.MethodGet, "/metrics").Body.String(), "sbms_exporter_config_last_reload_success 1")
+}
+
+func TestExporterReloadStopsRemovedDevices(t *testing.T) {
+	shed := DeviceConfig{Name: "shed", URL: "127.0.0.1:1"}
+	config := configWithDevices(shed)
+	var loadErr error
+	exporter := testExporter(t, &config, &loadErr)
+	shedPollers := exporter.current.Load().pollers[newPollerKey(config, shed)]
+
+	config = configWithDevices()
+	assert.Nil(t, exporter.Reload())
+	assert.Empty(t, exporter.current.Load().pollers)
+	assert.NotContains(t, get(exporter, http.MethodGet, "/metrics").Body.String(), `device="shed"`)
+	assert.NotNil(t, shedPollers.ctx.Err(), "removed device is still polled")
+}
+
+func TestExporterReloadMethod(t *testing.T) {
+	config := configWithDevices()
+	var loadErr error
+	exporter := testExporter(t, &config, &loadErr)
+	assert.Equal(t, http.StatusMethodNotAllowed, get(exporter, http.MethodGet, "/-/reload").Code)
+}
+
+func TestExporterReloadRenamedDeviceKeepsEnergy(t *testing.T) {
+	device := serveContent(readFileContent(t, "./__source__/rawData6"), http.StatusOK)
+	defer device.Close()
+
+	path := filepath.Join(t.TempDir(), "state.json")
+	state := &energyState{Devices: map[string]map[string]energyRegisterState{
+		"shed": {"battery_wh": {Last: 398000, Offset: 1000}},
+	}}
+	assert.Nil(t, state.save(path))
+
+	shed := DeviceConfig{Name: "shed", URL: device.URL}
+	config := configWithDevices(shed)
+	config.State.Path = path
+	var loadErr error
+	exporter := testExporter(t, &config, &loadErr)
+	total := `sbms_energy_battery_wh_total{battery_bank="",device="%s",site=""} 399056.7`
+	assert.Eventually(t, func() bool {
+		return strings.Contains(get(exporter, http.MethodGet, "/metrics").Body.String(), fmt.Sprintf(total, "shed"))
+	}, time.Second, 10*time.Millisecond)
+	shedPollers := exporter.current.Load().pollers[newPollerKey(config, shed)]
+
+	barn := DeviceConfig{Name: "barn", URL: device.URL}
+	config = configWithDevices(barn)
+	config.State.Path = path
+	assert.Nil(t, exporter.Reload())
+
+	// the renamed device has pollers of its own, but carries on from the totals of shed
+	assert.NotSame(t, shedPollers, exporter.current.Load().pollers[newPollerKey(config, barn)])
+	assert.Eventually(t, func() bool {
+		return exporter.current.Load().pollers[newPollerKey(config, barn)].rawData.Result().HasLatest
+	}, time.Second, 10*time.Millisecond)
+	assert.Contains(t, get(exporter, http.MethodGet, "/metrics").Body.String(), fmt.Sprintf(total, "barn"))
+}
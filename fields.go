@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// dataField is one reading of the rawData, named and with its unit,
+// for the sinks that push the readings rather than serve them as metrics
+type dataField struct {
+	name string
+	unit string
+	// deviceClass and stateClass are what Home Assistant calls them
+	deviceClass string
+	stateClass  string
+	value       func(d *SBMSData) float64
+	has         func(d *SBMSData) bool
+}
+
+const (
+	stateClassMeasurement     = "measurement"
+	stateClassTotalIncreasing = "total_increasing"
+)
+
+var dataFields = []dataField{
+	{name: "soc", unit: "%", deviceClass: "battery", stateClass: stateClassMeasurement, value: func(d *SBMSData) float64 { return d.soc }},
+	{name: "battery_voltage", unit: "mV", deviceClass: "voltage", stateClass: stateClassMeasurement, value: func(d *SBMSData) float64 { return d.batteryVoltage }},
+	{name: "battery_current", unit: "mA", deviceClass: "current", stateClass: stateClassMeasurement, value: func(d *SBMSData) float64 { return d.batteryCurrent }},
+	{name: "battery_power", unit: "W", deviceClass: "power", stateClass: stateClassMeasurement, value: func(d *SBMSData) float64 { return d.batteryPower }},
+	{name: "pv1_current", unit: "mA", deviceClass: "current", stateClass: stateClassMeasurement, value: func(d *SBMSData) float64 { return d.pv1Current }},
+	{name: "pv2_current", unit: "mA", deviceClass: "current", stateClass: stateClassMeasurement, value: func(d *SBMSData) float64 { return d.pv2Current }, has: hasPV2},
+	{name: "ext_current", unit: "mA", deviceClass: "current", stateClass: stateClassMeasurement, value: func(d *SBMSData) float64 { return d.externalCurrent }, has: hasExtLoad},
+	{name: "internal_temp", unit: "°C", deviceClass: "temperature", stateClass: stateClassMeasurement, value: func(d *SBMSData) float64 { return d.internalTemperature }},
+	{name: "external_temp", unit: "°C", deviceClass: "temperature", stateClass: stateClassMeasurement, value: func(d *SBMSData) float64 { return d.externalTemperature }},
+	{name: "ad2", value: func(d *SBMSData) float64 { return float64(d.adc2) }},
+	{name: "ad3", value: func(d *SBMSData) float64 { return float64(d.adc3) }},
+	{name: "ad4", value: func(d *SBMSData) float64 { return float64(d.adc4) }},
+	{name: "heat1", value: func(d *SBMSData) float64 { return float64(d.heat1) }},
+	{name: "heat2", value: func(d *SBMSData) float64 { return float64(d.heat2) }},
+	{name: "type", value: func(d *SBMSData) float64 { return d.cellType }},
+	{name: "capacity", value: func(d *SBMSData) float64 { return d.capacity }},
+	{name: "status", value: func(d *SBMSData) float64 { return d.status }},
+
+	{name: "energy_battery_wh", unit: "Wh", deviceClass: "energy", stateClass: stateClassTotalIncreasing, value: func(d *SBMSData) float64 { return d.batteryEnergyWh }},
+	{name: "energy_battery_ah", unit: "Ah", stateClass: stateClassTotalIncreasing, value: func(d *SBMSData) float64 { return d.batteryEnergyAh }},
+	{name: "energy_pv1_wh", unit: "Wh", deviceClass: "energy", stateClass: stateClassTotalIncreasing, value: func(d *SBMSData) float64 { return d.pV1EnergyWh }},
+	{name: "energy_pv1_ah", unit: "Ah", stateClass: stateClassTotalIncreasing, value: func(d *SBMSData) float64 { return d.pV1EnergyAh }},
+	{name: "energy_pv2_wh", unit: "Wh", deviceClass: "energy", stateClass: stateClassTotalIncreasing, value: func(d *SBMSData) float64 { return d.pV2EnergyWh }, has: hasPV2},
+	{name: "energy_pv2_ah", unit: "Ah", stateClass: stateClassTotalIncreasing, value: func(d *SBMSData) float64 { return d.pV2EnergyAh }, has: hasPV2},
+	{name: "energy_dmppt_wh", unit: "Wh", deviceClass: "energy", stateClass: stateClassTotalIncreasing, value: func(d *SBMSData) float64 { return d.dmpptEnergyWh }, has: hasDMPPTData},
+	{name: "energy_dmppt_ah", unit: "Ah", stateClass: stateClassTotalIncreasing, value: func(d *SBMSData) float64 { return d.dmpptEnergyAh }, has: hasDMPPTData},
+	{name: "energy_load_wh", unit: "Wh", deviceClass: "energy", stateClass: stateClassTotalIncreasing, value: func(d *SBMSData) float64 { return d.loadEnergyWh }},
+	{name: "energy_load_ah", unit: "Ah", stateClass: stateClassTotalIncreasing, value: func(d *SBMSData) float64 { return d.loadEnergyAh }},
+	{name: "energy_ext_load_wh", unit: "Wh", deviceClass: "energy", stateClass: stateClassTotalIncreasing, value: func(d *SBMSData) float64 { return d.extLoadEnergyWh }, has: hasExtLoad},
+	{name: "energy_ext_load_ah", unit: "Ah", stateClass: stateClassTotalIncreasing, value: func(d *SBMSData) float64 { return d.extLoadEnergyAh }, has: hasExtLoad},
+
+	{name: "dmppt_voltage", unit: "mV", deviceClass: "voltage", stateClass: stateClassMeasurement, value: func(d *SBMSData) float64 { return d.dmppt.voltage }, has: hasDMPPTData},
+	{name: "dmppt_pv1_out_current", unit: "mA", deviceClass: "current", stateClass: stateClassMeasurement, value: func(d *SBMSData) float64 { return d.dmppt.pv1OutCurrent }, has: hasDMPPTData},
+	{name: "dmppt_pv2_out_current", unit: "mA", deviceClass: "current", stateClass: stateClassMeasurement, value: func(d *SBMSData) float64 { return d.dmppt.pv2OutCurrent }, has: hasDMPPTData},
+	{name: "dmppt_temp235", unit: "°C", deviceClass: "temperature", stateClass: stateClassMeasurement, value: func(d *SBMSData) float64 { return d.dmppt.temp235 }, has: hasDMPPTData},
+	{name: "dmppt_temp146", unit: "°C", deviceClass: "temperature", stateClass: stateClassMeasurement, value: func(d *SBMSData) float64 { return d.dmppt.temp146 }, has: hasDMPPTData},
+	{name: "dmppt_internal_temp", unit: "°C", deviceClass: "temperature", stateClass: stateClassMeasurement, value: func(d *SBMSData) float64 { return d.dmppt.internalTemperature }, has: hasDMPPTData},
+}
+
+// flagField is one of the 15 flags of the SBMS0; problem is whether it being set is a fault
+type flagField struct {
+	name    string
+	help    string
+	problem bool
+	value   func(f Flags) bool
+}
+
+var flagFields = []flagField{
+	{name: "ov", help: "Over Voltage", problem: true, value: func(f Flags) bool { return f.OverVoltage }},
+	{name: "ovlk", help: "Over Voltage Lock", problem: true, value: func(f Flags) bool { return f.OverVoltageLock }},
+	{name: "uv", help: "Under Voltage", problem: true, value: func(f Flags) bool { return f.UnderVoltage }},
+	{name: "uvlk", help: "Under Voltage Lock", problem: true, value: func(f Flags) bool { return f.UnderVoltageLock }},
+	{name: "iot", help: "Internal Over Temperature", problem: true, value: func(f Flags) bool { return f.InternalOverTemperature }},
+	{name: "coc", help: "Charge Over Current", problem: true, value: func(f Flags) bool { return f.ChargeOverCurrent }},
+	{name: "doc", help: "Discharge Over Current", problem: true, value: func(f Flags) bool { return f.DischargeOverCurrent }},
+	{name: "dsc", help: "Discharge Short Circuit", problem: true, value: func(f Flags) bool { return f.DischargeShortCircuit }},
+	{name: "celf", help: "Cell Fail", problem: true, value: func(f Flags) bool { return f.CellFail }},
+	{name: "open", help: "Open Cell Wire", problem: true, value: func(f Flags) bool { return f.OpenCellWire }},
+	{name: "lvc", help: "Low Voltage Cell", problem: true, value: func(f Flags) bool { return f.LowVoltageCell }},
+	{name: "eccf", help: "EEPROM Fail", problem: true, value: func(f Flags) bool { return f.EEPROMFail }},
+	{name: "cfet", help: "Charge FET", value: func(f Flags) bool { return f.ChargeFETActive }},
+	{name: "eoc", help: "End Of Charge", value: func(f Flags) bool { return f.EndOfCharge }},
+	{name: "dfet", help: "Discharge FET", value: func(f Flags) bool { return f.DischargeFETActive }},
+}
+
+// fieldValues are the readings of d by name, leaving out the channels its model doesn't have;
+// cells are cell_<n> in mV and cell_<n>_balancing, flags are flag_<name>
+func fieldValues(d *SBMSData) map[string]any {
+	values := map[string]any{
+		"ts":            d.ts,
+		"model":         d.model,
+		"capacity_unit": d.capacityUnit,
+		"graph_unit":    d.graphUnit,
+	}
+	for _, f := range dataFields {
+		if f.has != nil && !f.has(d) {
+			continue
+		}
+		values[f.name] = f.value(d)
+	}
+	for i, cell := range d.cells {
+		values[cellFieldName(i)] = cell.mV
+		values[cellFieldName(i)+"_balancing"] = cell.isBalancing
+	}
+	for _, f := range flagFields {
+		values["flag_"+f.name] = f.value(d.flags)
+	}
+	return values
+}
+
+func cellFieldName(i int) string {
+	return fmt.Sprintf("cell_%d", i+1)
+}
+
+// fieldTitle is how a field is shown, e.g. "Battery voltage" for battery_voltage
+func fieldTitle(name string) string {
+	title := strings.ReplaceAll(name, "_", " ")
+	return strings.ToUpper(title[:1]) + title[1:]
+}
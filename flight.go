@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// flightGroup coalesces concurrent fetches of the same url, so however many pollers,
+// probes and history requests line up the ESP32 only sees one request at a time
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flight
+
+	// deduplicated counts the fetches that waited for another one instead of calling the device
+	deduplicated atomic.Uint64
+}
+
+// flight is a fetch in progress; b and err are set before done is closed
+type flight struct {
+	done chan struct{}
+	b    []byte
+	err  error
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{calls: map[string]*flight{}}
+}
+
+// do calls fetch, unless a fetch of url is already in flight, in which case it waits for that one.
+// The fetch isn't cancelled with the ctx of the caller that started it, as others may be waiting;
+// each caller stops waiting when its own ctx is done. A nil group doesn't coalesce anything.
+func (g *flightGroup) do(ctx context.Context, url string, fetch func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	if g == nil {
+		return fetch(ctx)
+	}
+
+	g.mu.Lock()
+	f, ok := g.calls[url]
+	if ok {
+		g.deduplicated.Add(1)
+	} else {
+		f = &flight{done: make(chan struct{})}
+		g.calls[url] = f
+		go func() {
+			f.b, f.err = fetch(context.WithoutCancel(ctx))
+			g.mu.Lock()
+			delete(g.calls, url)
+			g.mu.Unlock()
+			close(f.done)
+		}()
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.b, f.err
+	case <-ctx.Done():
+		return nil, &ScrapeError{Stage: stageHTTP, Err: ctx.Err()}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFlightGroupCoalescesConcurrentFetches(t *testing.T) {
+	release := make(chan struct{})
+	device, requests := countingServer(func(_ int32, w http.ResponseWriter, r *http.Request) {
+		<-release
+		_, _ = w.Write([]byte("ok"))
+	})
+	defer device.Close()
+
+	flights := newFlightGroup()
+	var wg sync.WaitGroup
+	results := make(chan string, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		// every scrape has a client of its own, like /probe
+		client := NewDeviceClient(testClientConfig(), flights)
+		go func() {
+			defer wg.Done()
+			b, err := client.Get(context.Background(), device.URL)
+			assert.Nil(t, err)
+			results <- string(b)
+		}()
+	}
+	assert.Eventually(t, func() bool { return flights.deduplicated.Load() == 4 }, time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(results)
+
+	assert.Equal(t, int32(1), requests.Load())
+	for b := range results {
+		assert.Equal(t, "ok", b)
+	}
+
+	// once the request is done the next one calls the device again
+	_, err := NewDeviceClient(testClientConfig(), flights).Get(context.Background(), device.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(2), requests.Load())
+	assert.Equal(t, uint64(4), flights.deduplicated.Load())
+}
+
+func TestFlightGroupWaiterCancelled(t *testing.T) {
+	release := make(chan struct{})
+	device, _ := countingServer(func(_ int32, w http.ResponseWriter, r *http.Request) {
+		<-release
+		_, _ = w.Write([]byte("ok"))
+	})
+	defer device.Close()
+	defer close(release)
+
+	flights := newFlightGroup()
+	client := NewDeviceClient(testClientConfig(), flights)
+	go func() { _, _ = client.Get(context.Background(), device.URL) }()
+	assert.Eventually(t, func() bool {
+		flights.mu.Lock()
+		defer flights.mu.Unlock()
+		return len(flights.calls) == 1
+	}, time.Second, time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := client.Get(ctx, device.URL)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, stageHTTP, scrapeErrorStage(err))
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// historyLength is the number of samples in each of the graph buffers
+const historyLength = 240
+
+// historySeries are the graph buffers in rawData, in the order they are returned by the api
+var historySeries = []string{"PV1", "PV2", "Btp", "Btn", "Ld", "ELd"}
+
+// historySections describes how the html page lays out the 240 samples. drawChart in
+// index.html draws each sample as a 3px bar, over the 360px of div12h, the 180px of div1h
+// and the 180px of div1m, so the first 120 bars cover 12 hours, the next 60 cover 1 hour,
+// and the last 60 cover 1 minute
+var historySections = []struct {
+	samples int
+	step    time.Duration
+}{
+	{samples: 120, step: 6 * time.Minute},
+	{samples: 60, step: time.Minute},
+	{samples: 60, step: time.Second},
+}
+
+const deviceTimeLayout = "2006-01-02T15:04:05"
+
+type HistorySample struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     float64   `json:"value"`
+}
+
+type HistorySeries struct {
+	Name    string          `json:"name"`
+	Samples []HistorySample `json:"samples"`
+}
+
+type History struct {
+	DeviceTime time.Time       `json:"deviceTime"`
+	Series     []HistorySeries `json:"series"`
+}
+
+// historyOffsets returns how long before the last sample each sample was taken
+func historyOffsets() []time.Duration {
+	offsets := make([]time.Duration, historyLength)
+	var before time.Duration = 0
+	i := historyLength - 1
+	for s := len(historySections) - 1; s >= 0; s-- {
+		for n := 0; n < historySections[s].samples; n++ {
+			offsets[i] = before
+			before += historySections[s].step
+			i--
+		}
+	}
+	return offsets
+}
+
+// parseDeviceTime parses the clock of the SBMS0, which has no timezone, as a time in loc
+func parseDeviceTime(ts string, loc *time.Location) (time.Time, error) {
+	return time.ParseInLocation(deviceTimeLayout, ts, loc)
+}
+
+// decodeHistoryBuffer reads the bar heights of one graph buffer;
+// like the html page each value is the height of the bar, from 0 to 90
+func decodeHistoryBuffer(buffer []uint16, deviceTime time.Time) []HistorySample {
+	var samples []HistorySample
+	offsets := historyOffsets()
+	for i := 0; i < historyLength && i < len(buffer); i++ {
+		samples = append(samples, HistorySample{
+			Timestamp: deviceTime.Add(-offsets[i]),
+			Value:     dcmp(i, 1, buffer),
+		})
+	}
+	return samples
+}
+
+// decodeHistory reads the graph buffers of rawData, timestamped from the clock of the
+// SBMS0 in loc; the variables are logged to logger at debug level
+func decodeHistory(b []byte, loc *time.Location, logger *slog.Logger) (*History, error) {
+	data, err := parseRawData(b, logger)
+	if err != nil {
+		return nil, err
+	}
+	deviceTime, err := parseDeviceTime(decodeDeviceTime(data.sbms), loc)
+	if err != nil {
+		return nil, err
+	}
+
+	output := &History{DeviceTime: deviceTime}
+	for _, name := range historySeries {
+		output.Series = append(output.Series, HistorySeries{
+			Name:    name,
+			Samples: decodeHistoryBuffer(data.history[name], deviceTime),
+		})
+	}
+	return output, nil
+}
+
+// HistoryHandler serves the graph buffers of the SBMS0 as json
+type HistoryHandler struct {
+	url    string
+	client *DeviceClient
+	// location is the timezone of the clock of the SBMS0
+	location *time.Location
+	logger   *slog.Logger
+}
+
+func (h HistoryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b, err := h.client.Get(r.Context(), h.url)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	history, err := decodeHistory(b, h.location, h.logger)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(history); err != nil {
+		h.logger.Warn("could not write history", "err", err)
+	}
+}
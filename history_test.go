@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHistoryRawData6(t *testing.T) {
+	content := readFileContent(t, "./__source__/rawData6")
+	perth, err := time.LoadLocation("Australia/Perth")
+	assert.Nil(t, err)
+	out, err := decodeHistory(content, perth, slog.Default())
+	assert.Nil(t, err)
+
+	// the clock of the device is read in the timezone it is set to
+	deviceTime := time.Date(2024, 2, 20, 13, 32, 56, 0, perth)
+	assert.Equal(t, time.Date(2024, 2, 20, 5, 32, 56, 0, time.UTC), out.DeviceTime.UTC())
+	assert.Equal(t, deviceTime, out.DeviceTime)
+	assert.Len(t, out.Series, 6)
+
+	pv1 := out.Series[0]
+	assert.Equal(t, "PV1", pv1.Name)
+	assert.Len(t, pv1.Samples, historyLength)
+	// PV1="th}yt]..." so the oldest sample is 't' and the 12h section starts 13 hours before the device time
+	assert.Equal(t, HistorySample{Timestamp: deviceTime.Add(-(119*6*time.Minute + 60*time.Minute + 60*time.Second)), Value: 81}, pv1.Samples[0])
+	assert.Equal(t, HistorySample{Timestamp: deviceTime, Value: 39}, pv1.Samples[historyLength-1])
+	assert.Equal(t, deviceTime.Add(-60*time.Second), pv1.Samples[179].Timestamp)
+}
+
+func TestHistoryHandler(t *testing.T) {
+	device := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(readFileContent(t, "./__source__/rawData6"))
+	}))
+	defer device.Close()
+
+	rec := httptest.NewRecorder()
+	HistoryHandler{url: device.URL, client: testClient(), location: time.UTC, logger: slog.Default()}.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/history", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	var out History
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &out))
+	assert.Equal(t, []string{"PV1", "PV2", "Btp", "Btn", "Ld", "ELd"}, []string{
+		out.Series[0].Name, out.Series[1].Name, out.Series[2].Name,
+		out.Series[3].Name, out.Series[4].Name, out.Series[5].Name,
+	})
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultInfluxMeasurement   = "sbms"
+	defaultInfluxBatchSize     = 500
+	defaultInfluxFlushInterval = 10 * time.Second
+	defaultInfluxRetries       = 3
+	defaultInfluxRetryBackoff  = time.Second
+	defaultInfluxTimeout       = 10 * time.Second
+	// influxUDPPacketSize keeps datagrams below a typical MTU
+	influxUDPPacketSize = 1400
+)
+
+// InfluxDBSinkConfig writes every poll as line protocol to InfluxDB
+type InfluxDBSinkConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// URL is e.g. http://localhost:8086 for the v2 write API, or udp://localhost:8089 for a UDP listener
+	URL    string `yaml:"url"`
+	Org    string `yaml:"org"`
+	Bucket string `yaml:"bucket"`
+	Token  string `yaml:"token"`
+	// Measurement is the measurement of the readings; the tasks go to <measurement>_task
+	Measurement string `yaml:"measurement"`
+	// lines are written once BatchSize of them are queued, or FlushInterval has passed
+	BatchSize     int           `yaml:"batch_size"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+	Retries       int           `yaml:"retries"`
+	RetryBackoff  time.Duration `yaml:"retry_backoff"`
+	Timeout       time.Duration `yaml:"timeout"`
+	// DeviceTime timestamps the readings with the clock of the SBMS0 rather than the time of the poll
+	DeviceTime bool `yaml:"device_time"`
+}
+
+func defaultInfluxDBSinkConfig() InfluxDBSinkConfig {
+	return InfluxDBSinkConfig{
+		Measurement:   defaultInfluxMeasurement,
+		BatchSize:     defaultInfluxBatchSize,
+		FlushInterval: defaultInfluxFlushInterval,
+		Retries:       defaultInfluxRetries,
+		RetryBackoff:  defaultInfluxRetryBackoff,
+		Timeout:       defaultInfluxTimeout,
+	}
+}
+
+func (c InfluxDBSinkConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("influxdb url: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https":
+		if c.Bucket == "" {
+			return errors.New("influxdb bucket is empty")
+		}
+	case "udp":
+	default:
+		return fmt.Errorf("influxdb url must be http, https or udp, not %q", c.URL)
+	}
+	if c.Measurement == "" {
+		return errors.New("influxdb measurement is empty")
+	}
+	if c.BatchSize <= 0 {
+		return fmt.Errorf("influxdb batch_size must be positive, not %d", c.BatchSize)
+	}
+	if c.FlushInterval <= 0 {
+		return fmt.Errorf("influxdb flush_interval must be positive, not %s", c.FlushInterval)
+	}
+	if c.Retries < 0 {
+		return fmt.Errorf("influxdb retries must not be negative, not %d", c.Retries)
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("influxdb timeout must be positive, not %s", c.Timeout)
+	}
+	return nil
+}
+
+// influxWriter writes a batch of lines
+type influxWriter interface {
+	write(ctx context.Context, lines []string) error
+	close()
+}
+
+// influxPermanentError is a write that would fail again if retried, e.g. a malformed line
+type influxPermanentError struct {
+	err error
+}
+
+func (e *influxPermanentError) Error() string {
+	return e.err.Error()
+}
+
+// InfluxDBSink batches the polls as line protocol, and writes the batches with retries
+type InfluxDBSink struct {
+	config InfluxDBSinkConfig
+	writer influxWriter
+	// location is the timezone of the clocks of the devices, for DeviceTime
+	location *time.Location
+	queue    *sinkQueue[[]string]
+	sleep    func(ctx context.Context, d time.Duration) error
+
+	// mu guards batch, which is written by the queue and by the flush ticker
+	mu    sync.Mutex
+	batch []string
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewInfluxDBSink(config InfluxDBSinkConfig, location *time.Location) (*InfluxDBSink, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, err
+	}
+	var writer influxWriter
+	if u.Scheme == "udp" {
+		writer = &influxUDPWriter{addr: u.Host}
+	} else {
+		writer = &influxHTTPWriter{config: config, http: &http.Client{Timeout: config.Timeout}}
+	}
+
+	s := &InfluxDBSink{config: config, writer: writer, location: location, sleep: sleepContext, done: make(chan struct{})}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.queue = newSinkQueue("influxdb", s.add)
+	go s.runFlusher()
+	return s, nil
+}
+
+func (s *InfluxDBSink) PublishRawData(device DeviceConfig, data *SBMSData) {
+	at := time.Now()
+	if s.config.DeviceTime {
+		if deviceTime, err := parseDeviceTime(data.ts, s.location); err == nil {
+			at = deviceTime
+		}
+	}
+	s.queue.push([]string{rawDataLine(s.config.Measurement, device, data, at)})
+}
+
+func (s *InfluxDBSink) PublishSystemTasks(device DeviceConfig, tasks []SystemTaskInfo) {
+	s.queue.push(systemTaskLines(s.config.Measurement+"_task", device, tasks, time.Now()))
+}
+
+// Close writes what is still queued, retrying for no longer than the timeout
+func (s *InfluxDBSink) Close() {
+	s.closeOnce.Do(func() {
+		s.queue.close()
+		close(s.done)
+		s.cancel()
+		ctx, cancel := context.WithTimeout(context.Background(), s.config.Timeout)
+		defer cancel()
+		s.flush(ctx)
+		s.writer.close()
+	})
+}
+
+func (s *InfluxDBSink) add(lines []string) {
+	s.mu.Lock()
+	s.batch = append(s.batch, lines...)
+	full := len(s.batch) >= s.config.BatchSize
+	s.mu.Unlock()
+	if full {
+		s.flush(s.ctx)
+	}
+}
+
+func (s *InfluxDBSink) runFlusher() {
+	ticker := time.NewTicker(s.config.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.flush(s.ctx)
+		}
+	}
+}
+
+// flush writes the batch, retrying with backoff unless the failure is permanent or ctx is done;
+// a batch that still can't be written is dropped
+func (s *InfluxDBSink) flush(ctx context.Context) {
+	s.mu.Lock()
+	lines := s.batch
+	s.batch = nil
+	s.mu.Unlock()
+	if len(lines) == 0 {
+		return
+	}
+
+	var err error
+	for attempt := 0; attempt <= s.config.Retries; attempt++ {
+		if attempt > 0 {
+			if s.sleep(ctx, s.config.RetryBackoff<<min(attempt-1, maxRetryBackoffExponent)) != nil {
+				break
+			}
+		}
+		if err = s.writer.write(ctx, lines); err == nil {
+			return
+		}
+		var permanent *influxPermanentError
+		if errors.As(err, &permanent) {
+			break
+		}
+	}
+	slog.Warn("could not write to influxdb, dropping lines", "lines", len(lines), "err", err)
+}
+
+// influxHTTPWriter writes to the v2 write API
+type influxHTTPWriter struct {
+	config InfluxDBSinkConfig
+	http   *http.Client
+}
+
+func (w *influxHTTPWriter) write(ctx context.Context, lines []string) error {
+	query := url.Values{"org": {w.config.Org}, "bucket": {w.config.Bucket}, "precision": {"ns"}}
+	body := strings.Join(lines, "\n") + "\n"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(w.config.URL, "/")+"/api/v2/write?"+query.Encode(), strings.NewReader(body))
+	if err != nil {
+		return &influxPermanentError{err: err}
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.config.Token != "" {
+		req.Header.Set("Authorization", "Token "+w.config.Token)
+	}
+	resp, err := w.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	err = fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(message))
+	// too many requests and server errors may pass, the other client errors won't
+	if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests {
+		return &influxPermanentError{err: err}
+	}
+	return err
+}
+
+func (w *influxHTTPWriter) close() {}
+
+// influxUDPWriter writes to a UDP listener, packing the lines into datagrams below the MTU.
+// It dials on the first write, so a host that doesn't resolve fails the writes, which are
+// retried, rather than the sink.
+type influxUDPWriter struct {
+	addr string
+
+	// mu guards conn, as the queue and the flush ticker both write
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (w *influxUDPWriter) write(_ context.Context, lines []string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.conn == nil {
+		conn, err := net.Dial("udp", w.addr)
+		if err != nil {
+			return err
+		}
+		w.conn = conn
+	}
+	var packet []byte
+	for _, line := range lines {
+		if len(packet) > 0 && len(packet)+len(line)+1 > influxUDPPacketSize {
+			if _, err := w.conn.Write(packet); err != nil {
+				return err
+			}
+			packet = packet[:0]
+		}
+		packet = append(packet, line...)
+		packet = append(packet, '\n')
+	}
+	if len(packet) > 0 {
+		if _, err := w.conn.Write(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *influxUDPWriter) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.conn != nil {
+		_ = w.conn.Close()
+	}
+}
+
+// rawDataLine is one line with every reading of data as a field, tagged with the device
+func rawDataLine(measurement string, device DeviceConfig, data *SBMSData, at time.Time) string {
+	var fields []string
+	for _, f := range dataFields {
+		if f.has != nil && !f.has(data) {
+			continue
+		}
+		fields = append(fields, influxFloatField(f.name, f.value(data)))
+	}
+	for i, cell := range data.cells {
+		fields = append(fields, influxFloatField(cellFieldName(i), float64(cell.mV)))
+		fields = append(fields, influxEscape(cellFieldName(i)+"_balancing")+"="+strconv.FormatBool(cell.isBalancing))
+	}
+	for _, f := range flagFields {
+		fields = append(fields, influxEscape("flag_"+f.name)+"="+strconv.FormatBool(f.value(data.flags)))
+	}
+	return influxLine(measurement, influxDeviceTags(device, data.model), fields, at)
+}
+
+// systemTaskLines are a line for each task of the debug endpoint
+func systemTaskLines(measurement string, device DeviceConfig, tasks []SystemTaskInfo, at time.Time) []string {
+	lines := make([]string, 0, len(tasks))
+	for _, t := range tasks {
+		fields := []string{
+			influxFloatField("state", t.state),
+			influxFloatField("priority", t.priority),
+			influxFloatField("run_time", t.runTimeCounter),
+			influxFloatField("run_time_percent", t.runTimePercent),
+		}
+		lines = append(lines, influxLine(measurement, append(influxDeviceTags(device, ""), "task="+influxEscape(t.name)), fields, at))
+	}
+	return lines
+}
+
+// influxDeviceTags are the labels the device has on its Prometheus series, sorted and
+// leaving out empty ones, as line protocol has no empty tag values; like MQTT and the
+// API, an unnamed device is tagged by its host
+func influxDeviceTags(device DeviceConfig, model string) []string {
+	var tags []string
+	for _, tag := range []struct{ key, value string }{
+		{"battery_bank", device.BatteryBank},
+		{"device", device.id()},
+		{"model", model},
+		{"site", device.Site},
+	} {
+		if tag.value != "" {
+			tags = append(tags, tag.key+"="+influxEscape(tag.value))
+		}
+	}
+	return tags
+}
+
+func influxLine(measurement string, tags, fields []string, at time.Time) string {
+	key := strings.NewReplacer(",", `\,`, " ", `\ `).Replace(measurement)
+	if len(tags) > 0 {
+		key += "," + strings.Join(tags, ",")
+	}
+	return key + " " + strings.Join(fields, ",") + " " + strconv.FormatInt(at.UnixNano(), 10)
+}
+
+func influxFloatField(key string, value float64) string {
+	return influxEscape(key) + "=" + strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// influxEscape escapes a tag key, tag value or field key
+func influxEscape(s string) string {
+	return strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `).Replace(s)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// influxServer records the bodies written to it, answering with the statuses in turn and then 204
+type influxServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   []string
+}
+
+func newInfluxServer(statuses ...int) *influxServer {
+	s := &influxServer{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.requests = append(s.requests, r)
+		s.bodies = append(s.bodies, string(body))
+		status := http.StatusNoContent
+		if len(s.statuses) > 0 {
+			status, s.statuses = s.statuses[0], s.statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	return s
+}
+
+func (s *influxServer) written() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.bodies...)
+}
+
+func testInfluxConfig(url string) InfluxDBSinkConfig {
+	config := defaultInfluxDBSinkConfig()
+	config.Enabled = true
+	config.URL = url
+	config.Org = "home"
+	config.Bucket = "solar"
+	config.Token = "secret"
+	config.FlushInterval = time.Hour
+	return config
+}
+
+func testInfluxSink(t *testing.T, config InfluxDBSinkConfig) *InfluxDBSink {
+	sink, err := NewInfluxDBSink(config, time.UTC)
+	assert.Nil(t, err)
+	sink.sleep = func(ctx context.Context, d time.Duration) error { return ctx.Err() }
+	return sink
+}
+
+func TestRawDataLine(t *testing.T) {
+	data, err := Decode(readFileContent(t, "./__source__/rawData6"))
+	assert.Nil(t, err)
+	line := rawDataLine("sbms", DeviceConfig{Name: "shed", Site: "home farm"}, data, time.Unix(1700000000, 0))
+
+	assert.True(t, strings.HasPrefix(line, `sbms,device=shed,model=SBMS0,site=home\ farm soc=69,battery_voltage=26479,`), line)
+	assert.Contains(t, line, ",cell_1=3310,cell_1_balancing=false,")
+	assert.Contains(t, line, ",energy_pv1_wh=725043.8,")
+	assert.Contains(t, line, ",flag_cfet=true,")
+	assert.True(t, strings.HasSuffix(line, " 1700000000000000000"), line)
+	assert.NotContains(t, line, "dmppt_voltage")
+}
+
+func TestRawDataLineUnnamedDevice(t *testing.T) {
+	data, err := Decode(readFileContent(t, "./__source__/rawData6"))
+	assert.Nil(t, err)
+	// e.g. a debug poll that didn't tell the model
+	data.model = ""
+	line := rawDataLine("sbms", DeviceConfig{URL: "http://192.168.1.10"}, data, time.Unix(1700000000, 0))
+
+	assert.True(t, strings.HasPrefix(line, `sbms,device=192.168.1.10 soc=69,`), line)
+}
+
+func TestSystemTaskLines(t *testing.T) {
+	lines := systemTaskLines("sbms_task", DeviceConfig{}, []SystemTaskInfo{{name: "IDLE 0", state: 1, priority: 0, runTimeCounter: 10, runTimePercent: 50}}, time.Unix(1, 0))
+	assert.Equal(t, []string{`sbms_task,task=IDLE\ 0 state=1,priority=0,run_time=10,run_time_percent=50 1000000000`}, lines)
+}
+
+func TestInfluxDBSinkBatches(t *testing.T) {
+	server := newInfluxServer()
+	defer server.Close()
+	config := testInfluxConfig(server.URL)
+	config.BatchSize = 3
+	config.DeviceTime = true
+	sink := testInfluxSink(t, config)
+
+	data, err := Decode(readFileContent(t, "./__source__/rawData6"))
+	assert.Nil(t, err)
+	sink.PublishRawData(DeviceConfig{Name: "shed"}, data)
+	sink.PublishRawData(DeviceConfig{Name: "shed"}, data)
+	sink.PublishSystemTasks(DeviceConfig{Name: "shed"}, []SystemTaskInfo{{name: "loop"}})
+	assert.Eventually(t, func() bool { return len(server.written()) == 1 }, time.Second, 10*time.Millisecond)
+
+	body := server.written()[0]
+	assert.Equal(t, 3, strings.Count(body, "\n"))
+	assert.Contains(t, body, "sbms_task,device=shed,task=loop ")
+	deviceTime, err := parseDeviceTime("2024-02-20T13:32:56", time.UTC)
+	assert.Nil(t, err)
+	assert.Contains(t, body, " "+strconv.FormatInt(deviceTime.UnixNano(), 10)+"\n")
+
+	r := server.requests[0]
+	assert.Equal(t, "/api/v2/write", r.URL.Path)
+	assert.Equal(t, "solar", r.URL.Query().Get("bucket"))
+	assert.Equal(t, "home", r.URL.Query().Get("org"))
+	assert.Equal(t, "Token secret", r.Header.Get("Authorization"))
+
+	// what is left is written on close
+	sink.PublishSystemTasks(DeviceConfig{Name: "shed"}, []SystemTaskInfo{{name: "loop"}})
+	sink.Close()
+	assert.Len(t, server.written(), 2)
+}
+
+func TestInfluxDBSinkRetries(t *testing.T) {
+	cases := map[string]struct {
+		statuses []int
+		requests int
+	}{
+		"server error":      {statuses: []int{http.StatusInternalServerError, http.StatusServiceUnavailable}, requests: 3},
+		"too many requests": {statuses: []int{http.StatusTooManyRequests}, requests: 2},
+		"bad request":       {statuses: []int{http.StatusBadRequest}, requests: 1},
+		"always failing":    {statuses: []int{500, 500, 500, 500, 500}, requests: 4},
+	}
+	for name, c := range cases {
+		server := newInfluxServer(c.statuses...)
+		sink := testInfluxSink(t, testInfluxConfig(server.URL))
+		sink.PublishSystemTasks(DeviceConfig{}, []SystemTaskInfo{{name: "loop"}})
+		sink.Close()
+
+		written := server.written()
+		assert.Len(t, written, c.requests, name)
+		for _, body := range written {
+			assert.Equal(t, written[0], body, name)
+		}
+		server.Close()
+	}
+}
+
+func TestInfluxDBSinkUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	config := testInfluxConfig("udp://" + conn.LocalAddr().String())
+	config.Bucket = ""
+	sink := testInfluxSink(t, config)
+	tasks := make([]SystemTaskInfo, 40)
+	for i := range tasks {
+		tasks[i] = SystemTaskInfo{name: "task"}
+	}
+	sink.PublishSystemTasks(DeviceConfig{Name: "shed"}, tasks)
+	sink.Close()
+
+	// the lines are split over datagrams that fit the MTU
+	var lines int
+	buf := make([]byte, 65536)
+	assert.Nil(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	for lines < len(tasks) {
+		n, _, err := conn.ReadFrom(buf)
+		if !assert.Nil(t, err) {
+			break
+		}
+		assert.LessOrEqual(t, n, influxUDPPacketSize)
+		lines += strings.Count(string(buf[:n]), "\n")
+	}
+	assert.Equal(t, len(tasks), lines)
+}
+
+func TestInfluxDBSinkUnresolvedHost(t *testing.T) {
+	config := testInfluxConfig("udp://nonexistent.invalid:8089")
+	config.Bucket = ""
+	sink := testInfluxSink(t, config)
+	sink.PublishSystemTasks(DeviceConfig{Name: "shed"}, []SystemTaskInfo{{name: "task"}})
+	sink.Close()
+}
+
+func TestExporterFailedReloadKeepsInfluxDBSink(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer conn.Close()
+	device := serveContent(readFileContent(t, "./__source__/rawData6"), http.StatusOK)
+	defer device.Close()
+
+	config := configWithDevices(DeviceConfig{Name: "shed", URL: device.URL})
+	config.Collectors = []string{collectorRawData}
+	config.PollInterval = 50 * time.Millisecond
+	config.Sinks.InfluxDB = testInfluxConfig("udp://" + conn.LocalAddr().String())
+	config.Sinks.InfluxDB.BatchSize = 1
+	var loadErr error
+	exporter := testExporter(t, &config, &loadErr)
+	sink := exporter.current.Load().sinks["influxdb"].sink
+
+	invalid := *config
+	invalid.Sinks.InfluxDB.BatchSize = 0
+	config = &invalid
+	assert.NotNil(t, exporter.Reload())
+	assert.Same(t, sink, exporter.current.Load().sinks["influxdb"].sink)
+
+	// the sink still writes the polls made after the failed reload
+	buf := make([]byte, 65536)
+	for {
+		assert.Nil(t, conn.SetReadDeadline(time.Now().Add(10*time.Millisecond)))
+		if _, _, err := conn.ReadFrom(buf); err != nil {
+			break
+		}
+	}
+	assert.Nil(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	n, _, err := conn.ReadFrom(buf)
+	assert.Nil(t, err)
+	assert.Contains(t, string(buf[:n]), "device=shed")
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// The rawData endpoint is a javascript file made of variable declarations like
+//
+//	var sbms="#$'8H4$%GLGQ...";
+//	var s1=['Ah','A','SBMS0  '];
+//	var s2=[0,0,0,0,0,0,0,0,7,8,1,1];
+//
+// This is a small parser for just that subset of javascript:
+// var/let/const declarations of strings, numbers and arrays of those, and comments.
+
+type jsKind int
+
+const (
+	jsString jsKind = iota
+	jsNumber
+	jsArray
+)
+
+func (k jsKind) String() string {
+	switch k {
+	case jsString:
+		return "string"
+	case jsNumber:
+		return "number"
+	case jsArray:
+		return "array"
+	}
+	return "unknown"
+}
+
+// JSPosition is a 1-based line and column in the source
+type JSPosition struct {
+	Line   int
+	Column int
+}
+
+func (p JSPosition) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
+// JSSyntaxError is returned when the source is not in the subset of javascript we understand
+type JSSyntaxError struct {
+	Pos JSPosition
+	Msg string
+}
+
+func (e *JSSyntaxError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Pos, e.Msg)
+}
+
+// EscapeError is returned for an escape sequence in a string literal that can't be decoded
+type EscapeError struct {
+	Pos      JSPosition
+	Sequence string
+}
+
+func (e *EscapeError) Error() string {
+	return fmt.Sprintf("%s: bad escape sequence %q", e.Pos, e.Sequence)
+}
+
+type jsValue struct {
+	kind jsKind
+	pos  JSPosition
+	// str is a string literal as UTF-16 code units, which is how javascript sees strings
+	str    []uint16
+	number float64
+	array  []jsValue
+}
+
+type jsParser struct {
+	src  string
+	off  int
+	line int
+	col  int
+}
+
+func (p *jsParser) pos() JSPosition {
+	return JSPosition{Line: p.line, Column: p.col}
+}
+
+func (p *jsParser) errorf(pos JSPosition, format string, args ...interface{}) error {
+	return &JSSyntaxError{Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *jsParser) eof() bool {
+	return p.off >= len(p.src)
+}
+
+// peek returns the next rune without consuming it, or -1 at the end of the source
+func (p *jsParser) peek() rune {
+	if p.eof() {
+		return -1
+	}
+	r, _ := utf8.DecodeRuneInString(p.src[p.off:])
+	return r
+}
+
+func (p *jsParser) next() rune {
+	if p.eof() {
+		return -1
+	}
+	r, size := utf8.DecodeRuneInString(p.src[p.off:])
+	p.off += size
+	if r == '\n' {
+		p.line++
+		p.col = 1
+	} else {
+		p.col++
+	}
+	return r
+}
+
+// skipSpace skips whitespace and comments
+func (p *jsParser) skipSpace() error {
+	for !p.eof() {
+		r := p.peek()
+		switch {
+		case unicode.IsSpace(r):
+			p.next()
+		case r == '/' && p.off+1 < len(p.src) && p.src[p.off+1] == '/':
+			for !p.eof() && p.peek() != '\n' {
+				p.next()
+			}
+		case r == '/' && p.off+1 < len(p.src) && p.src[p.off+1] == '*':
+			start := p.pos()
+			p.next()
+			p.next()
+			for {
+				if p.eof() {
+					return p.errorf(start, "unterminated comment")
+				}
+				if p.next() == '*' && p.peek() == '/' {
+					p.next()
+					break
+				}
+			}
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func isIdentStart(r rune) bool {
+	return r == '_' || r == '$' || unicode.IsLetter(r)
+}
+
+func isIdentPart(r rune) bool {
+	return isIdentStart(r) || unicode.IsDigit(r)
+}
+
+func (p *jsParser) ident() (string, error) {
+	start := p.off
+	pos := p.pos()
+	if !isIdentStart(p.peek()) {
+		return "", p.errorf(pos, "expected identifier, found %s", p.describeNext())
+	}
+	for !p.eof() && isIdentPart(p.peek()) {
+		p.next()
+	}
+	return p.src[start:p.off], nil
+}
+
+func (p *jsParser) describeNext() string {
+	if p.eof() {
+		return "end of input"
+	}
+	return strconv.QuoteRune(p.peek())
+}
+
+func (p *jsParser) expect(r rune) error {
+	if err := p.skipSpace(); err != nil {
+		return err
+	}
+	if p.peek() != r {
+		return p.errorf(p.pos(), "expected %q, found %s", r, p.describeNext())
+	}
+	p.next()
+	return nil
+}
+
+func (p *jsParser) value() (jsValue, error) {
+	if err := p.skipSpace(); err != nil {
+		return jsValue{}, err
+	}
+	pos := p.pos()
+	r := p.peek()
+	switch {
+	case r == '"' || r == '\'':
+		str, err := p.string()
+		return jsValue{kind: jsString, pos: pos, str: str}, err
+	case r == '[':
+		return p.arrayLiteral()
+	case r == '-' || r == '+' || r == '.' || isDigit(r):
+		return p.numberLiteral()
+	}
+	return jsValue{}, p.errorf(pos, "expected a string, number or array, found %s", p.describeNext())
+}
+
+func (p *jsParser) arrayLiteral() (jsValue, error) {
+	out := jsValue{kind: jsArray, pos: p.pos(), array: []jsValue{}}
+	p.next()
+	for {
+		if err := p.skipSpace(); err != nil {
+			return out, err
+		}
+		if p.peek() == ']' {
+			p.next()
+			return out, nil
+		}
+		v, err := p.value()
+		if err != nil {
+			return out, err
+		}
+		out.array = append(out.array, v)
+		if err := p.skipSpace(); err != nil {
+			return out, err
+		}
+		switch p.peek() {
+		case ',':
+			p.next()
+		case ']':
+		default:
+			return out, p.errorf(p.pos(), "expected ',' or ']' in array, found %s", p.describeNext())
+		}
+	}
+}
+
+func isDigit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
+
+func isHexDigit(r rune) bool {
+	return isDigit(r) || (r >= 'a' && r <= 'f') || (r >= 'A' && r <= 'F')
+}
+
+func (p *jsParser) numberLiteral() (jsValue, error) {
+	pos := p.pos()
+	start := p.off
+	if r := p.peek(); r == '-' || r == '+' {
+		p.next()
+	}
+	digits := p.off
+	if p.peek() == '0' && p.off+1 < len(p.src) && (p.src[p.off+1] == 'x' || p.src[p.off+1] == 'X') {
+		p.next()
+		p.next()
+		for isHexDigit(p.peek()) {
+			p.next()
+		}
+		integer, err := strconv.ParseInt(p.src[digits:p.off], 0, 64)
+		if err != nil {
+			return jsValue{}, p.errorf(pos, "invalid number %q", p.src[start:p.off])
+		}
+		if p.src[start] == '-' {
+			integer = -integer
+		}
+		return jsValue{kind: jsNumber, pos: pos, number: float64(integer)}, nil
+	}
+	for isDigit(p.peek()) || p.peek() == '.' {
+		p.next()
+	}
+	if r := p.peek(); r == 'e' || r == 'E' {
+		p.next()
+		if r := p.peek(); r == '-' || r == '+' {
+			p.next()
+		}
+		for isDigit(p.peek()) {
+			p.next()
+		}
+	}
+	number, err := strconv.ParseFloat(p.src[start:p.off], 64)
+	if err != nil {
+		return jsValue{}, p.errorf(pos, "invalid number %q", p.src[start:p.off])
+	}
+	return jsValue{kind: jsNumber, pos: pos, number: number}, nil
+}
+
+func hexValue(s string) (uint32, bool) {
+	if len(s) == 0 {
+		return 0, false
+	}
+	v, err := strconv.ParseUint(s, 16, 32)
+	return uint32(v), err == nil
+}
+
+// string reads a string literal, decoding every javascript escape sequence
+func (p *jsParser) string() ([]uint16, error) {
+	start := p.pos()
+	quote := p.next()
+	out := []uint16{}
+	for {
+		if p.eof() {
+			return nil, p.errorf(start, "unterminated string")
+		}
+		pos := p.pos()
+		r := p.next()
+		switch r {
+		case quote:
+			return out, nil
+		case '\n', '\r':
+			return nil, p.errorf(pos, "newline in string")
+		case '\\':
+			escaped, err := p.escape(pos)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, escaped...)
+		default:
+			out = append(out, utf16.Encode([]rune{r})...)
+		}
+	}
+}
+
+// escapeError reports a bad escape sequence starting at the backslash at pos
+func (p *jsParser) escapeError(pos JSPosition, begin int) error {
+	end := p.off
+	if end > len(p.src) {
+		end = len(p.src)
+	}
+	return &EscapeError{Pos: pos, Sequence: "\\" + p.src[begin:end]}
+}
+
+func (p *jsParser) escape(pos JSPosition) ([]uint16, error) {
+	if p.eof() {
+		return nil, &EscapeError{Pos: pos, Sequence: "\\"}
+	}
+	begin := p.off
+	r := p.next()
+	switch r {
+	case 'n':
+		return []uint16{'\n'}, nil
+	case 'r':
+		return []uint16{'\r'}, nil
+	case 't':
+		return []uint16{'\t'}, nil
+	case 'b':
+		return []uint16{'\b'}, nil
+	case 'f':
+		return []uint16{'\f'}, nil
+	case 'v':
+		return []uint16{'\v'}, nil
+	case '\n':
+		// line continuation
+		return nil, nil
+	case '\r':
+		if p.peek() == '\n' {
+			p.next()
+		}
+		return nil, nil
+	case 'x':
+		if p.off+2 > len(p.src) {
+			p.off = len(p.src)
+			return nil, p.escapeError(pos, begin)
+		}
+		v, ok := hexValue(p.src[p.off : p.off+2])
+		if !ok {
+			p.off += 2
+			return nil, p.escapeError(pos, begin)
+		}
+		p.next()
+		p.next()
+		return []uint16{uint16(v)}, nil
+	case 'u':
+		if p.peek() == '{' {
+			p.next()
+			digits := p.off
+			for !p.eof() && p.peek() != '}' {
+				p.next()
+			}
+			v, ok := hexValue(p.src[digits:p.off])
+			if p.eof() || !ok || v > unicode.MaxRune {
+				return nil, p.escapeError(pos, begin)
+			}
+			p.next()
+			return utf16.Encode([]rune{rune(v)}), nil
+		}
+		if p.off+4 > len(p.src) {
+			p.off = len(p.src)
+			return nil, p.escapeError(pos, begin)
+		}
+		v, ok := hexValue(p.src[p.off : p.off+4])
+		if !ok {
+			p.off += 4
+			return nil, p.escapeError(pos, begin)
+		}
+		for i := 0; i < 4; i++ {
+			p.next()
+		}
+		return []uint16{uint16(v)}, nil
+	}
+	if r >= '0' && r <= '7' {
+		// legacy octal escape, at most 3 digits and at most \377
+		v := uint16(r - '0')
+		for i := 0; i < 2; i++ {
+			next := p.peek()
+			if next < '0' || next > '7' || v*8+uint16(next-'0') > 0377 {
+				break
+			}
+			v = v*8 + uint16(p.next()-'0')
+		}
+		return []uint16{v}, nil
+	}
+	// any other escaped character is just that character
+	return utf16.Encode([]rune{r}), nil
+}
+
+// declaration parses `var name = value, other = value;`
+func (p *jsParser) declaration(output map[string]jsValue) error {
+	for {
+		if err := p.skipSpace(); err != nil {
+			return err
+		}
+		name, err := p.ident()
+		if err != nil {
+			return err
+		}
+		if err := p.expect('='); err != nil {
+			return err
+		}
+		v, err := p.value()
+		if err != nil {
+			return err
+		}
+		output[name] = v
+
+		if err := p.skipSpace(); err != nil {
+			return err
+		}
+		switch p.peek() {
+		case ',':
+			p.next()
+			continue
+		case ';':
+			p.next()
+		}
+		return nil
+	}
+}
+
+// parseJSVariables returns all variables declared in content
+func parseJSVariables(content []byte) (map[string]jsValue, error) {
+	output := map[string]jsValue{}
+	p := &jsParser{src: string(content), line: 1, col: 1}
+	for {
+		if err := p.skipSpace(); err != nil {
+			return nil, err
+		}
+		if p.eof() {
+			return output, nil
+		}
+		if p.peek() == ';' {
+			p.next()
+			continue
+		}
+		pos := p.pos()
+		keyword, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		if keyword != "var" && keyword != "let" && keyword != "const" {
+			return nil, p.errorf(pos, "expected variable declaration, found %q", keyword)
+		}
+		if err := p.declaration(output); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// asString returns the value of a string variable
+func (v jsValue) asString() ([]uint16, error) {
+	if v.kind != jsString {
+		return nil, &JSSyntaxError{Pos: v.pos, Msg: fmt.Sprintf("expected string, found %s", v.kind)}
+	}
+	return v.str, nil
+}
+
+// asIntArray returns the value of an array of whole numbers
+func (v jsValue) asIntArray() ([]int64, error) {
+	if v.kind != jsArray {
+		return nil, &JSSyntaxError{Pos: v.pos, Msg: fmt.Sprintf("expected array, found %s", v.kind)}
+	}
+	var out []int64
+	for _, e := range v.array {
+		if e.kind != jsNumber || e.number != float64(int64(e.number)) {
+			return nil, &JSSyntaxError{Pos: e.pos, Msg: "expected whole number"}
+		}
+		out = append(out, int64(e.number))
+	}
+	return out, nil
+}
+
+// asStringArray returns the value of an array of strings
+func (v jsValue) asStringArray() ([]string, error) {
+	if v.kind != jsArray {
+		return nil, &JSSyntaxError{Pos: v.pos, Msg: fmt.Sprintf("expected array, found %s", v.kind)}
+	}
+	var out []string
+	for _, e := range v.array {
+		if e.kind != jsString {
+			return nil, &JSSyntaxError{Pos: e.pos, Msg: fmt.Sprintf("expected string, found %s", e.kind)}
+		}
+		out = append(out, string(utf16.Decode(e.str)))
+	}
+	return out, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"unicode/utf16"
+)
+
+func parseSingle(t *testing.T, src string) jsValue {
+	variables, err := parseJSVariables([]byte(src))
+	assert.Nil(t, err)
+	return variables["v"]
+}
+
+func TestParseJSStringEscapes(t *testing.T) {
+	cases := map[string]string{
+		`var v="a\\b";`:            `a\b`,
+		`var v="a\"b";`:            `a"b`,
+		`var v='a\'b';`:            `a'b`,
+		`var v="\n\r\t\b\f\v";`:    "\n\r\t\b\f\v",
+		`var v="\x41\x7e";`:        "A~",
+		`var v="\u0041\u{1F600}";`: "A\U0001F600",
+		`var v="\101\0";`:          "A\x00",
+		`var v="\q";`:              "q",
+		"var v=\"a\\\nb\";":        "ab",
+		`var v="a;b";`:             "a;b",
+	}
+	for src, expected := range cases {
+		v := parseSingle(t, src)
+		assert.Equal(t, utf16.Encode([]rune(expected)), v.str, src)
+	}
+}
+
+func TestParseJSArrays(t *testing.T) {
+	s1, err := parseSingle(t, `var v=['Ah','A','SBMS0  '];`).asStringArray()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"Ah", "A", "SBMS0  "}, s1)
+
+	s2, err := parseSingle(t, "var v=[0, 1,\n -2, 0x10, ];").asIntArray()
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{0, 1, -2, 16}, s2)
+
+	_, err = parseSingle(t, `var v=[1.5];`).asIntArray()
+	assert.NotNil(t, err)
+}
+
+func TestParseJSMultiLineStatementsAndComments(t *testing.T) {
+	variables, err := parseJSVariables([]byte("// a comment\nvar a =\n  \"x\", b = 2 /* another */\nlet c = [\n'y'\n];const d=3"))
+	assert.Nil(t, err)
+	assert.Equal(t, []uint16{'x'}, variables["a"].str)
+	assert.Equal(t, float64(2), variables["b"].number)
+	assert.Equal(t, jsArray, variables["c"].kind)
+	assert.Equal(t, float64(3), variables["d"].number)
+}
+
+func TestParseJSErrorPositions(t *testing.T) {
+	cases := map[string]JSPosition{
+		"var a=\"abc":        {Line: 1, Column: 7},
+		"var a=1;\nfoo b=1;": {Line: 2, Column: 1},
+		"var a=[1 2];":       {Line: 1, Column: 10},
+		"var a=\"a\nb\";":    {Line: 1, Column: 9},
+		"var a=;":            {Line: 1, Column: 7},
+		"/* never closed":    {Line: 1, Column: 1},
+	}
+	for src, expected := range cases {
+		_, err := parseJSVariables([]byte(src))
+		var syntaxErr *JSSyntaxError
+		if assert.True(t, errors.As(err, &syntaxErr), src) {
+			assert.Equal(t, expected, syntaxErr.Pos, src)
+		}
+	}
+}
+
+func TestParseJSBadEscapes(t *testing.T) {
+	cases := map[string]EscapeError{
+		"var a=1;\nvar b=\"\\xZZ\";": {Pos: JSPosition{Line: 2, Column: 8}, Sequence: `\xZZ`},
+		`var a="\u12";`:              {Pos: JSPosition{Line: 1, Column: 8}, Sequence: `\u12";`},
+		`var a="\u{110000}";`:        {Pos: JSPosition{Line: 1, Column: 8}, Sequence: `\u{110000`},
+	}
+	for src, expected := range cases {
+		_, err := parseJSVariables([]byte(src))
+		var escapeErr *EscapeError
+		if assert.True(t, errors.As(err, &escapeErr), src) {
+			assert.Equal(t, expected, *escapeErr, src)
+		}
+	}
+}
+
+func TestParseJSFixtures(t *testing.T) {
+	paths, _ := filepath.Glob("./__source__/rawData*")
+	for _, path := range paths {
+		variables, err := parseJSVariables(readFileContent(t, path))
+		assert.Nil(t, err, path)
+		assert.Contains(t, variables, "sbms", path)
+	}
+
+	// rawData has an escaped backslash in gsbms
+	variables, err := parseJSVariables(readFileContent(t, "./__source__/rawData"))
+	assert.Nil(t, err)
+	assert.Equal(t, []uint16{'+', '\\', 'x'}, variables["gsbms"].str[18:21])
+}
+
+func FuzzParseJSVariables(f *testing.F) {
+	paths, _ := filepath.Glob("./__source__/rawData*")
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(content)
+	}
+	f.Fuzz(func(t *testing.T, content []byte) {
+		variables, err := parseJSVariables(content)
+		if err != nil {
+			var syntaxErr *JSSyntaxError
+			var escapeErr *EscapeError
+			if !errors.As(err, &syntaxErr) && !errors.As(err, &escapeErr) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			return
+		}
+		// decoding must never panic, whatever the variables hold
+		out, err := Decode(content)
+		if err == nil && out == nil {
+			t.Fatalf("no error and no output for %d variables", len(variables))
+		}
+	})
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"unicode/utf16"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// LogConfig is how the exporter logs
+type LogConfig struct {
+	// Level is debug, info, warn or error; debug logs every response and decoded field
+	Level  string `yaml:"level"`
+	Format string `yaml:"format"`
+}
+
+func defaultLogConfig() LogConfig {
+	return LogConfig{Level: "info", Format: logFormatText}
+}
+
+func (c LogConfig) level() (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Level)); err != nil {
+		return 0, fmt.Errorf("log level: %w", err)
+	}
+	return level, nil
+}
+
+func (c LogConfig) validate() error {
+	if _, err := c.level(); err != nil {
+		return err
+	}
+	if c.Format != logFormatText && c.Format != logFormatJSON {
+		return fmt.Errorf("log format must be %s or %s, not %s", logFormatText, logFormatJSON, c.Format)
+	}
+	return nil
+}
+
+// newLogger logs to w in the format of config, at the level held by level
+// so that it can be changed on reload
+func newLogger(w io.Writer, config LogConfig, level *slog.LevelVar) (*slog.Logger, error) {
+	l, err := config.level()
+	if err != nil {
+		return nil, err
+	}
+	level.Set(l)
+	opts := &slog.HandlerOptions{Level: level}
+	switch config.Format {
+	case logFormatJSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	}
+}
+
+// deviceLogger tags the log lines about a device with its name, or its url if it has none
+func deviceLogger(logger *slog.Logger, name, url string) *slog.Logger {
+	if name == "" {
+		name = url
+	}
+	return logger.With("device", name)
+}
+
+// LogValue logs the decoded fields by name, which is only worked out when debug logging is on
+func (d *SBMSData) LogValue() slog.Value {
+	cells := make([]int, len(d.cells))
+	for i, cell := range d.cells {
+		cells[i] = cell.mV
+	}
+	attrs := []slog.Attr{
+		slog.String("ts", d.ts),
+		slog.String("model", d.model),
+		slog.Float64("soc", d.soc),
+		slog.Any("cells", cells),
+		slog.Float64("batteryVoltage", d.batteryVoltage),
+		slog.Float64("batteryCurrent", d.batteryCurrent),
+		slog.Float64("batteryPower", d.batteryPower),
+		slog.Float64("pv1Current", d.pv1Current),
+		slog.Float64("pv2Current", d.pv2Current),
+		slog.Float64("externalCurrent", d.externalCurrent),
+		slog.Float64("internalTemperature", d.internalTemperature),
+		slog.Float64("externalTemperature", d.externalTemperature),
+		slog.Float64("status", d.status),
+		slog.Float64("batteryEnergyWh", d.batteryEnergyWh),
+		slog.Float64("pV1EnergyWh", d.pV1EnergyWh),
+		slog.Float64("pV2EnergyWh", d.pV2EnergyWh),
+		slog.Float64("loadEnergyWh", d.loadEnergyWh),
+		slog.Float64("extLoadEnergyWh", d.extLoadEnergyWh),
+		slog.Float64("dmpptEnergyWh", d.dmpptEnergyWh),
+		slog.Bool("dmppt", d.dmppt != nil),
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// LogValue logs a javascript value the way it was written
+func (v jsValue) LogValue() slog.Value {
+	switch v.kind {
+	case jsString:
+		return slog.StringValue(string(utf16.Decode(v.str)))
+	case jsNumber:
+		return slog.Float64Value(v.number)
+	default:
+		values := make([]any, len(v.array))
+		for i, element := range v.array {
+			values[i] = element.LogValue().Any()
+		}
+		return slog.AnyValue(values)
+	}
+}
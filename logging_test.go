@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNewLoggerJSON(t *testing.T) {
+	var buf bytes.Buffer
+	level := new(slog.LevelVar)
+	logger, err := newLogger(&buf, LogConfig{Level: "warn", Format: logFormatJSON}, level)
+	assert.Nil(t, err)
+
+	logger.Info("hidden")
+	deviceLogger(logger, "shed", "192.168.1.10").Warn("could not scrape", "stage", stageHTTP)
+	var line map[string]any
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(t, "could not scrape", line["msg"])
+	assert.Equal(t, "shed", line["device"])
+	assert.Equal(t, stageHTTP, line["stage"])
+
+	// the level can be changed after the logger was created
+	buf.Reset()
+	level.Set(slog.LevelDebug)
+	logger.Debug("shown")
+	assert.Contains(t, buf.String(), "shown")
+}
+
+func TestDecodeRawDataDebugLog(t *testing.T) {
+	b := readFileContent(t, "./__source__/rawData6")
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, LogConfig{Level: "debug", Format: logFormatText}, new(slog.LevelVar))
+	assert.Nil(t, err)
+
+	_, err = decodeRawData(b, deviceLogger(logger, "", "192.168.1.10"))
+	assert.Nil(t, err)
+	assert.Contains(t, buf.String(), "device=192.168.1.10")
+	assert.Contains(t, buf.String(), "field=sbms")
+	assert.Contains(t, buf.String(), "data.soc=")
+}
+
+func TestHistoryHandlerLogsDevice(t *testing.T) {
+	device := serveContent(readFileContent(t, "./__source__/rawData6"), http.StatusOK)
+	defer device.Close()
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, LogConfig{Level: "debug", Format: logFormatText}, new(slog.LevelVar))
+	assert.Nil(t, err)
+
+	handler := HistoryHandler{url: device.URL, client: testClient(), location: time.UTC, logger: deviceLogger(logger, "shed", device.URL)}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/history", nil))
+	assert.Contains(t, buf.String(), "device=shed")
+	assert.Contains(t, buf.String(), "field=sbms")
+}
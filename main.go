@@ -1,124 +1,144 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/collectors"
-	"github.com/prometheus/client_golang/prometheus/promauto"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"io"
 	"log"
+	"log/slog"
 	"math"
 	"net/http"
 	"net/url"
 	"os"
-	"regexp"
-	"slices"
+	"os/signal"
 	"strconv"
 	"strings"
-	"unicode/utf16"
+	"syscall"
+	// the docker image has no zoneinfo for device_timezone to load
+	_ "time/tzdata"
 )
 
-var (
-	respBytes = prometheus.NewCounter(prometheus.CounterOpts{Namespace: "sbms", Subsystem: "exporter", Name: "resp_bytes", Help: "Number of bytes received"})
-	reqsCount = prometheus.NewCounter(prometheus.CounterOpts{Namespace: "sbms", Subsystem: "exporter", Name: "requests", Help: "Number of requests made"})
-	Soc       = promauto.NewGauge(prometheus.GaugeOpts{
-		Namespace: "sbms",
-		Name:      "battery_soc",
-		Help:      "State of Charge",
-	})
-	Cell1Voltage   = cellVoltageGauge(1)
-	Cell2Voltage   = cellVoltageGauge(2)
-	Cell3Voltage   = cellVoltageGauge(3)
-	Cell4Voltage   = cellVoltageGauge(4)
-	Cell5Voltage   = cellVoltageGauge(5)
-	Cell6Voltage   = cellVoltageGauge(6)
-	Cell7Voltage   = cellVoltageGauge(7)
-	Cell8Voltage   = cellVoltageGauge(8)
-	Cell1Balancing = cellBalancingGauge(1)
-	Cell2Balancing = cellBalancingGauge(2)
-	Cell3Balancing = cellBalancingGauge(3)
-	Cell4Balancing = cellBalancingGauge(4)
-	Cell5Balancing = cellBalancingGauge(5)
-	Cell6Balancing = cellBalancingGauge(6)
-	Cell7Balancing = cellBalancingGauge(7)
-	Cell8Balancing = cellBalancingGauge(8)
-	TempInt        = promauto.NewGauge(prometheus.GaugeOpts{
-		Namespace: "sbms",
-		Name:      "internal_temp",
-	})
-	TempExt = promauto.NewGauge(prometheus.GaugeOpts{
-		Namespace: "sbms",
-		Name:      "external_temp",
-	})
-	BatteryPower   = promauto.NewGauge(prometheus.GaugeOpts{Namespace: "sbms", Name: "battery_power"})
-	BatteryVoltage = promauto.NewGauge(prometheus.GaugeOpts{Namespace: "sbms", Name: "battery_voltage"})
-	BatteryCurrent = promauto.NewGauge(prometheus.GaugeOpts{Namespace: "sbms", Name: "battery_current"})
-	CurrentPv1     = promauto.NewGauge(prometheus.GaugeOpts{Namespace: "sbms", Name: "pv1_current"})
-	CurrentPv2     = promauto.NewGauge(prometheus.GaugeOpts{Namespace: "sbms", Name: "pv2_current"})
-	CurrentExtLoad = promauto.NewGauge(prometheus.GaugeOpts{Namespace: "sbms", Name: "ext_current"})
-	Ad2            = promauto.NewGauge(prometheus.GaugeOpts{Namespace: "sbms", Name: "ad2"})
-	Ad3            = promauto.NewGauge(prometheus.GaugeOpts{Namespace: "sbms", Name: "ad3"})
-	Ad4            = promauto.NewGauge(prometheus.GaugeOpts{Namespace: "sbms", Name: "ad4"})
-	Heat1          = promauto.NewGauge(prometheus.GaugeOpts{Namespace: "sbms", Name: "heat1"})
-	Heat2          = promauto.NewGauge(prometheus.GaugeOpts{Namespace: "sbms", Name: "heat2"})
-	Ov             = promauto.NewGauge(prometheus.GaugeOpts{Namespace: "sbms", Subsystem: "flag", Name: "ov", Help: "Over Voltage"})
-	Ovlk           = promauto.NewGauge(prometheus.GaugeOpts{Namespace: "sbms", Subsystem: "flag", Name: "ovlk", Help: "Over Voltage Lock"})
-	Uv             = promauto.NewGauge(prometheus.GaugeOpts{Namespace: "sbms", Subsystem: "flag", Name: "uv", Help: "Under Voltage"})
-	Uvlk           = promauto.NewGauge(prometheus.GaugeOpts{Namespace: "sbms", Subsystem: "flag", Name: "uvlk", Help: "Under Voltage Lock"})
-	Iot            = promauto.NewGauge(prometheus.GaugeOpts{Namespace: "sbms", Subsystem: "flag", Name: "iot"})
-	Coc            = promauto.NewGauge(prometheus.GaugeOpts{Namespace: "sbms", Subsystem: "flag", Name: "coc", Help: "Charge Over Current"})
-	Doc            = promauto.NewGauge(prometheus.GaugeOpts{Namespace: "sbms", Subsystem: "flag", Name: "doc", Help: "Discharge Over Current"})
-	Dsc            = promauto.NewGauge(prometheus.GaugeOpts{Namespace: "sbms", Subsystem: "flag", Name: "dsc", Help: "Discharge Short Circuit"})
-	Celf           = promauto.NewGauge(prometheus.GaugeOpts{Namespace: "sbms", Subsystem: "flag", Name: "celf", Help: "Cell Fail"})
-	Open           = promauto.NewGauge(prometheus.GaugeOpts{Namespace: "sbms", Subsystem: "flag", Name: "open", Help: "OpenCellWire Cell Wire"})
-	Lvc            = promauto.NewGauge(prometheus.GaugeOpts{Namespace: "sbms", Subsystem: "flag", Name: "lvc", Help: "Low Voltage Cell"})
-	Eccf           = promauto.NewGauge(prometheus.GaugeOpts{Namespace: "sbms", Subsystem: "flag", Name: "eccf"})
-	Cfet           = promauto.NewGauge(prometheus.GaugeOpts{Namespace: "sbms", Subsystem: "flag", Name: "cfet", Help: "Charge FET"})
-	Eoc            = promauto.NewGauge(prometheus.GaugeOpts{Namespace: "sbms", Subsystem: "flag", Name: "eoc", Help: "End Of Charge"})
-	Dfet           = promauto.NewGauge(prometheus.GaugeOpts{Namespace: "sbms", Subsystem: "flag", Name: "dfet", Help: "Discharge FET"})
-
-	batteryEnergyWh = promauto.NewGauge(prometheus.GaugeOpts{Namespace: "sbms", Subsystem: "energy", Name: "battery_wh"})
-	batteryEnergyAh = promauto.NewGauge(prometheus.GaugeOpts{Namespace: "sbms", Subsystem: "energy", Name: "battery_ah"})
-	pV1EnergyWh     = promauto.NewGauge(prometheus.GaugeOpts{Namespace: "sbms", Subsystem: "energy", Name: "pv1_wh"})
-	pV1EnergyAh     = promauto.NewGauge(prometheus.GaugeOpts{Namespace: "sbms", Subsystem: "energy", Name: "pv1_ah"})
-	pV2EnergyWh     = promauto.NewGauge(prometheus.GaugeOpts{Namespace: "sbms", Subsystem: "energy", Name: "pv2_wh"})
-	pV2EnergyAh     = promauto.NewGauge(prometheus.GaugeOpts{Namespace: "sbms", Subsystem: "energy", Name: "pv2_ah"})
-	dmpptEnergyWh   = promauto.NewGauge(prometheus.GaugeOpts{Namespace: "sbms", Subsystem: "energy", Name: "dmppt_wh"})
-	dmpptEnergyAh   = promauto.NewGauge(prometheus.GaugeOpts{Namespace: "sbms", Subsystem: "energy", Name: "dmppt_ah"})
-	loadEnergyWh    = promauto.NewGauge(prometheus.GaugeOpts{Namespace: "sbms", Subsystem: "energy", Name: "load_wh"})
-	loadEnergyAh    = promauto.NewGauge(prometheus.GaugeOpts{Namespace: "sbms", Subsystem: "energy", Name: "load_ah"})
-	extLoadEnergyWh = promauto.NewGauge(prometheus.GaugeOpts{Namespace: "sbms", Subsystem: "energy", Name: "ext_load_wh"})
-	extLoadEnergyAh = promauto.NewGauge(prometheus.GaugeOpts{Namespace: "sbms", Subsystem: "energy", Name: "ext_load_ah"})
-	cellType        = promauto.NewGauge(prometheus.GaugeOpts{Namespace: "sbms", Name: "type"})
-	capacity        = promauto.NewGauge(prometheus.GaugeOpts{Namespace: "sbms", Name: "capacity"})
-	status          = promauto.NewGauge(prometheus.GaugeOpts{Namespace: "sbms", Name: "status"})
-
-	systemTaskPriority       = promauto.NewGaugeVec(prometheus.GaugeOpts{Namespace: "sbms", Subsystem: "system", Name: "task_priority"}, []string{"task"})
-	systemTaskRunTime        = promauto.NewGaugeVec(prometheus.GaugeOpts{Namespace: "sbms", Subsystem: "system", Name: "task_run_time"}, []string{"task"})
-	systemTaskRunTimePercent = promauto.NewGaugeVec(prometheus.GaugeOpts{Namespace: "sbms", Subsystem: "system", Name: "task_run_time_percent"}, []string{"task"})
-	systemTaskState          = promauto.NewGaugeVec(prometheus.GaugeOpts{Namespace: "sbms", Subsystem: "system", Name: "task_state"}, []string{"task"})
-)
+// rawDataGauge is one gauge of the rawData endpoint, read from the decoded SBMSData
+type rawDataGauge struct {
+	subsystem string
+	name      string
+	help      string
+	value     func(d *SBMSData) float64
+	// has is whether the SBMS0 has the gauge, nil if every model does
+	has func(d *SBMSData) bool
+}
+
+func hasPV2(d *SBMSData) bool     { return d.layout.pv2 }
+func hasExtLoad(d *SBMSData) bool { return d.layout.extLoad }
+
+// hasDMPPTData is true when a DMPPT450 attached to the SBMS0 filled in the dmppt block
+func hasDMPPTData(d *SBMSData) bool { return d.dmppt != nil }
+
+var rawDataGauges = []rawDataGauge{
+	{name: "battery_soc", help: "State of Charge", value: func(d *SBMSData) float64 { return d.soc }},
+	{name: "cell_count", help: "Number of cells detected in the battery", value: func(d *SBMSData) float64 { return float64(len(d.cells)) }},
+	{name: "internal_temp", value: func(d *SBMSData) float64 { return d.internalTemperature }},
+	{name: "external_temp", value: func(d *SBMSData) float64 { return d.externalTemperature }},
+	{name: "battery_power", value: func(d *SBMSData) float64 { return d.batteryPower }},
+	{name: "battery_voltage", value: func(d *SBMSData) float64 { return d.batteryVoltage }},
+	{name: "battery_current", value: func(d *SBMSData) float64 { return d.batteryCurrent }},
+	{name: "pv1_current", value: func(d *SBMSData) float64 { return d.pv1Current }},
+	{name: "pv2_current", value: func(d *SBMSData) float64 { return d.pv2Current }, has: hasPV2},
+	{name: "ext_current", value: func(d *SBMSData) float64 { return d.externalCurrent }, has: hasExtLoad},
+	{name: "ad2", value: func(d *SBMSData) float64 { return float64(d.adc2) }},
+	{name: "ad3", value: func(d *SBMSData) float64 { return float64(d.adc3) }},
+	{name: "ad4", value: func(d *SBMSData) float64 { return float64(d.adc4) }},
+	{name: "heat1", value: func(d *SBMSData) float64 { return float64(d.heat1) }},
+	{name: "heat2", value: func(d *SBMSData) float64 { return float64(d.heat2) }},
+	{name: "type", value: func(d *SBMSData) float64 { return d.cellType }},
+	{name: "capacity", help: "Battery Capacity, in the unit of the capacity_unit label of sbms_info", value: func(d *SBMSData) float64 { return d.capacity }},
+	{name: "status", value: func(d *SBMSData) float64 { return d.status }},
+
+	{subsystem: "flag", name: "ov", help: "Over Voltage", value: func(d *SBMSData) float64 { return boolToFloat(d.flags.OverVoltage) }},
+	{subsystem: "flag", name: "ovlk", help: "Over Voltage Lock", value: func(d *SBMSData) float64 { return boolToFloat(d.flags.OverVoltageLock) }},
+	{subsystem: "flag", name: "uv", help: "Under Voltage", value: func(d *SBMSData) float64 { return boolToFloat(d.flags.UnderVoltage) }},
+	{subsystem: "flag", name: "uvlk", help: "Under Voltage Lock", value: func(d *SBMSData) float64 { return boolToFloat(d.flags.UnderVoltageLock) }},
+	{subsystem: "flag", name: "iot", value: func(d *SBMSData) float64 { return boolToFloat(d.flags.InternalOverTemperature) }},
+	{subsystem: "flag", name: "coc", help: "Charge Over Current", value: func(d *SBMSData) float64 { return boolToFloat(d.flags.ChargeOverCurrent) }},
+	{subsystem: "flag", name: "doc", help: "Discharge Over Current", value: func(d *SBMSData) float64 { return boolToFloat(d.flags.DischargeOverCurrent) }},
+	{subsystem: "flag", name: "dsc", help: "Discharge Short Circuit", value: func(d *SBMSData) float64 { return boolToFloat(d.flags.DischargeShortCircuit) }},
+	{subsystem: "flag", name: "celf", help: "Cell Fail", value: func(d *SBMSData) float64 { return boolToFloat(d.flags.CellFail) }},
+	{subsystem: "flag", name: "open", help: "OpenCellWire Cell Wire", value: func(d *SBMSData) float64 { return boolToFloat(d.flags.OpenCellWire) }},
+	{subsystem: "flag", name: "lvc", help: "Low Voltage Cell", value: func(d *SBMSData) float64 { return boolToFloat(d.flags.LowVoltageCell) }},
+	{subsystem: "flag", name: "eccf", value: func(d *SBMSData) float64 { return boolToFloat(d.flags.EEPROMFail) }},
+	{subsystem: "flag", name: "cfet", help: "Charge FET", value: func(d *SBMSData) float64 { return boolToFloat(d.flags.ChargeFETActive) }},
+	{subsystem: "flag", name: "eoc", help: "End Of Charge", value: func(d *SBMSData) float64 { return boolToFloat(d.flags.EndOfCharge) }},
+	{subsystem: "flag", name: "dfet", help: "Discharge FET", value: func(d *SBMSData) float64 { return boolToFloat(d.flags.DischargeFETActive) }},
+
+	{subsystem: "dmppt", name: "version", help: "DMPPT Firmware Version", value: func(d *SBMSData) float64 { return d.dmppt.version }, has: hasDMPPTData},
+	{subsystem: "dmppt", name: "voltage", help: "DMPPT Voltage", value: func(d *SBMSData) float64 { return d.dmppt.voltage }, has: hasDMPPTData},
+	{subsystem: "dmppt", name: "pv1_out_current", help: "DMPPT PV1OUT Current", value: func(d *SBMSData) float64 { return d.dmppt.pv1OutCurrent }, has: hasDMPPTData},
+	{subsystem: "dmppt", name: "pv2_out_current", help: "DMPPT PV2OUT Current", value: func(d *SBMSData) float64 { return d.dmppt.pv2OutCurrent }, has: hasDMPPTData},
+	{subsystem: "dmppt", name: "temp235", help: "DMPPT Temperature of channels 2, 3 and 5", value: func(d *SBMSData) float64 { return d.dmppt.temp235 }, has: hasDMPPTData},
+	{subsystem: "dmppt", name: "temp146", help: "DMPPT Temperature of channels 1, 4 and 6", value: func(d *SBMSData) float64 { return d.dmppt.temp146 }, has: hasDMPPTData},
+	{subsystem: "dmppt", name: "internal_temp", help: "DMPPT Internal Temperature", value: func(d *SBMSData) float64 { return d.dmppt.internalTemperature }, has: hasDMPPTData},
+}
+
+// rawDataDescs describe the metrics of the rawData endpoint of one SBMS0, with the labels of that device
+type rawDataDescs struct {
+	gauges              []*prometheus.Desc
+	cellVoltage         *prometheus.Desc
+	cellBalancing       *prometheus.Desc
+	info                *prometheus.Desc
+	dmpptChannelCurrent *prometheus.Desc
+	averageCurrent      *prometheus.Desc
+	averagePower        *prometheus.Desc
+	energy              energyDescs
+}
+
+func newRawDataDescs(prefix string, labels prometheus.Labels) rawDataDescs {
+	descs := rawDataDescs{
+		cellVoltage:         prometheus.NewDesc(prefix+"_cell_voltage", "Cell Voltage", []string{"cell"}, labels),
+		cellBalancing:       prometheus.NewDesc(prefix+"_cell_balancing", "Cell Balancing", []string{"cell"}, labels),
+		info:                prometheus.NewDesc(prefix+"_info", "Model and units configured on the SBMS0", []string{"model", "capacity_unit", "graph_unit"}, labels),
+		dmpptChannelCurrent: prometheus.NewDesc(prefix+"_dmppt_channel_current", "DMPPT PV Output Current", []string{"channel"}, labels),
+		averageCurrent:      prometheus.NewDesc(prefix+"_average_current", "Average Current calculated by the SBMS0, in A", []string{"source", "window"}, labels),
+		averagePower:        prometheus.NewDesc(prefix+"_average_power", "Average Power calculated by the SBMS0, in W", []string{"source", "window"}, labels),
+		energy:              newEnergyDescs(prefix, labels),
+	}
+	for _, g := range rawDataGauges {
+		descs.gauges = append(descs.gauges, prometheus.NewDesc(prometheus.BuildFQName(prefix, g.subsystem, g.name), g.help, nil, labels))
+	}
+	return descs
+}
+
+func (d rawDataDescs) describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range d.gauges {
+		ch <- desc
+	}
+	ch <- d.cellVoltage
+	ch <- d.cellBalancing
+	ch <- d.info
+	ch <- d.dmpptChannelCurrent
+	ch <- d.averageCurrent
+	ch <- d.averagePower
+	d.energy.describe(ch)
+}
+
+// systemTaskGauge is one gauge of the debug endpoint, with a series per task
+type systemTaskGauge struct {
+	name  string
+	value func(t SystemTaskInfo) float64
+}
 
-func cellVoltageGauge(idx int) prometheus.Gauge {
-	return promauto.NewGauge(prometheus.GaugeOpts{
-		Namespace: "sbms",
-		Name:      "cell_voltage",
-		Help:      "Cell Voltage",
-		ConstLabels: map[string]string{
-			"cell": strconv.Itoa(idx),
-		},
-	})
-}
-func cellBalancingGauge(idx int) prometheus.Gauge {
-	return promauto.NewGauge(prometheus.GaugeOpts{
-		Namespace: "sbms",
-		Name:      "cell_balancing",
-		Help:      "Cell Balancing",
-		ConstLabels: map[string]string{
-			"cell": strconv.Itoa(idx),
-		},
-	})
+var systemTaskGauges = []systemTaskGauge{
+	{name: "task_priority", value: func(t SystemTaskInfo) float64 { return t.priority }},
+	{name: "task_run_time", value: func(t SystemTaskInfo) float64 { return t.runTimeCounter }},
+	{name: "task_run_time_percent", value: func(t SystemTaskInfo) float64 { return t.runTimePercent }},
+	{name: "task_state", value: func(t SystemTaskInfo) float64 { return t.state }},
+}
+
+func newSystemTaskDescs(prefix string, labels prometheus.Labels) []*prometheus.Desc {
+	var descs []*prometheus.Desc
+	for _, g := range systemTaskGauges {
+		descs = append(descs, prometheus.NewDesc(prometheus.BuildFQName(prefix, "system", g.name), "", []string{"task"}, labels))
+	}
+	return descs
 }
 
 func boolToFloat(b bool) float64 {
@@ -151,6 +171,24 @@ type Flags struct {
 	DischargeFETActive      bool
 }
 
+type DMPPTData struct {
+	version             float64
+	voltage             float64
+	channelCurrents     []float64
+	pv1OutCurrent       float64
+	pv2OutCurrent       float64
+	temp235             float64
+	temp146             float64
+	internalTemperature float64
+}
+
+// Average is one of the rolling averages the SBMS0 shows next to its graphs
+type Average struct {
+	source string
+	window string
+	value  float64
+}
+
 type SystemTaskInfo struct {
 	name           string
 	state          float64
@@ -194,24 +232,39 @@ type SBMSData struct {
 	cellType            float64
 	capacity            float64
 	status              float64
+	dmppt               *DMPPTData
+	model               string
+	// layout is that of model, resolved once when decoding
+	layout       ModelLayout
+	capacityUnit string
+	graphUnit    string
+	averages     []Average
 }
 
+// dcmp decodes count base 91 digits of runes, most significant first
 func dcmp(offset, count int, runes []uint16) float64 {
 	var sum float64 = 0
-	var l = ""
 	for z := 0; z < count; z++ {
 		i := offset + count - 1 - z
-		r := runes[i]
-		n1 := r - 35
+		n1 := runes[i] - 35
 		n2 := math.Pow(91, float64(z))
-		v := float64(n1) * n2
-		sum = sum + v
-		l += fmt.Sprintf("rune %d is %d is %s is %f; ", i, r, string(utf16.Decode([]uint16{r})), v)
+		sum = sum + float64(n1)*n2
 	}
-	log.Printf("offset=%d count=%d sum=%f debug=%s\n", offset, count, sum, l)
 	return sum
 }
 
+// decodeDeviceTime reads the clock of the SBMS0 from the first 6 runes of sbms
+func decodeDeviceTime(sbms []uint16) string {
+	Y := dcmp(0, 1, sbms)
+	M := dcmp(1, 1, sbms)
+	D := dcmp(2, 1, sbms)
+	H := dcmp(3, 1, sbms)
+	m := dcmp(4, 1, sbms)
+	S := dcmp(5, 1, sbms)
+
+	return fmt.Sprintf("20%d-%02d-%02dT%02d:%02d:%02d", int(Y), int(M), int(D), int(H), int(m), int(S))
+}
+
 func binToBool(bin rune) bool {
 	if bin == '1' {
 		return true
@@ -259,11 +312,25 @@ func decodeDebugResponse(b []byte) []SystemTaskInfo {
 	return tasks
 }
 
-func decodeResponse(b []byte) *SBMSData {
+// Decode decodes the response of the rawData endpoint, logging untagged; rawData
+// of a device is decoded with decodeRawData and the deviceLogger of that device
+func Decode(b []byte) (*SBMSData, error) {
+	return decodeRawData(b, slog.Default())
+}
+
+// decodeRawData decodes the response of the rawData endpoint,
+// logging the variables and the decoded fields at debug level
+func decodeRawData(b []byte, logger *slog.Logger) (*SBMSData, error) {
+	return decodeRawDataCells(b, logger, 0)
+}
+
+// decodeRawDataCells is decodeRawData for a battery known to have at least cells cells,
+// which are kept even when the last of them read nonsense, e.g. a dead cell or an open wire
+func decodeRawDataCells(b []byte, logger *slog.Logger, cells int) (*SBMSData, error) {
 	output := new(SBMSData)
-	data, err := parseRawData(b)
+	data, err := parseRawData(b, logger)
 	if err != nil {
-		return nil
+		return nil, err
 	}
 
 	sbms := data.sbms
@@ -271,27 +338,35 @@ func decodeResponse(b []byte) *SBMSData {
 	xsbms := data.xsbms
 	eW := data.eW
 	eA := data.eA
+	dmppt := data.dmppt
+	gsbms := data.gsbms
 
-	Y := dcmp(0, 1, sbms)
-	M := dcmp(1, 1, sbms)
-	D := dcmp(2, 1, sbms)
-	H := dcmp(3, 1, sbms)
-	m := dcmp(4, 1, sbms)
-	S := dcmp(5, 1, sbms)
+	output.capacityUnit, output.graphUnit, output.model = decodeUnits(data.s1)
+	layout, known := layoutFor(output.model)
+	if !known {
+		warnUnknownModel(logger, output.model)
+	}
+	output.layout = layout
 
-	output.ts = fmt.Sprintf("20%d-%02d-%02dT%02d:%02d:%02d", int(Y), int(M), int(D), int(H), int(m), int(S))
+	output.ts = decodeDeviceTime(sbms)
 
 	output.soc = dcmp(6, 2, sbms)
+	output.minMV = int(dcmp(5, 2, xsbms))
+	output.maxMV = int(dcmp(3, 2, xsbms))
+
 	output.cells = []Cell{}
-	var batteryVoltage float64 = 0
-	for i := 0; i < 8; i++ {
-		cellMv := dcmp((i*2)+8, 2, sbms)
-		batteryVoltage += cellMv
+	for i := 0; i < maxCells; i++ {
 		output.cells = append(output.cells, Cell{
-			mV:          int(cellMv),
+			mV:          int(dcmp((i*2)+8, 2, sbms)),
 			isBalancing: s2[i] == 1,
 		})
 	}
+	output.cells = output.cells[:max(detectCellCount(output.cells, output.minMV, output.maxMV), min(cells, len(output.cells)))]
+
+	var batteryVoltage float64 = 0
+	for _, cell := range output.cells {
+		batteryVoltage += float64(cell.mV)
+	}
 	output.batteryVoltage = batteryVoltage
 
 	output.internalTemperature = (dcmp(24, 2, sbms) - 450) / 10
@@ -306,8 +381,12 @@ func decodeResponse(b []byte) *SBMSData {
 
 	output.batteryCurrent = dcmp(29, 3, sbms) * scalar
 	output.pv1Current = dcmp(32, 3, sbms)
-	output.pv2Current = dcmp(35, 3, sbms)
-	output.externalCurrent = dcmp(38, 3, sbms)
+	if layout.pv2 {
+		output.pv2Current = dcmp(35, 3, sbms)
+	}
+	if layout.extLoad {
+		output.externalCurrent = dcmp(38, 3, sbms)
+	}
 
 	output.batteryPower = batteryVoltage / 1000 * output.batteryCurrent / 1000
 
@@ -355,11 +434,6 @@ func decodeResponse(b []byte) *SBMSData {
 		OverVoltage:             binToBool(errorRunes[14]),
 	}
 
-	output.minMV = int(dcmp(5, 2, xsbms))
-	output.maxMV = int(dcmp(3, 2, xsbms))
-
-	// todo sometimes we get zero from these counters for some reason, we should potentially exclude those as invalid
-
 	//Batt
 	output.batteryEnergyWh = dcmp(0*6, 6, eW) / 10
 	output.batteryEnergyAh = dcmp(0*6, 6, eA) / 1000
@@ -369,251 +443,367 @@ func decodeResponse(b []byte) *SBMSData {
 	output.pV1EnergyAh = dcmp(1*6, 6, eA) / 1000
 
 	//PV2
-	output.pV2EnergyWh = dcmp(2*6, 6, eW) / 10
-	output.pV2EnergyAh = dcmp(2*6, 6, eA) / 1000
-
-	//DMPPT
-	output.dmpptEnergyWh = dcmp(3*6, 6, eW)
-	output.dmpptEnergyAh = dcmp(3*6, 6, eA)
+	if layout.pv2 {
+		output.pV2EnergyWh = dcmp(2*6, 6, eW) / 10
+		output.pV2EnergyAh = dcmp(2*6, 6, eA) / 1000
+	}
 
 	//Load
 	output.loadEnergyWh = dcmp(5*6, 6, eW) / 10
 	output.loadEnergyAh = dcmp(5*6, 6, eA) / 1000
 
 	//ExtLd
-	output.extLoadEnergyWh = dcmp(6*6, 6, eW) / 10
-	output.extLoadEnergyAh = dcmp(6*6, 6, eA) / 1000
+	if layout.extLoad {
+		output.extLoadEnergyWh = dcmp(6*6, 6, eW) / 10
+		output.extLoadEnergyAh = dcmp(6*6, 6, eA) / 1000
+	}
 
 	output.cellType = dcmp(7, 1, xsbms)
 	output.capacity = dcmp(8, 3, xsbms)
 	output.status = dcmp(56, 3, sbms)
 
-	return output
+	//DMPPT
+	// the registers overflow when no DMPPT450 is attached, so like index.html they're only
+	// read with one; like the other registers, eW is in tenths of a Wh and eA in mAh
+	if layout.dmppt && hasDMPPT(eA, dmppt) {
+		output.dmpptEnergyWh = dcmp(3*6, 6, eW) / 10
+		output.dmpptEnergyAh = dcmp(3*6, 6, eA) / 1000
+		output.dmppt = decodeDMPPT(dmppt)
+	}
+
+	output.averages = decodeAverages(gsbms, output.graphUnit)
+
+	logger.Debug("decoded rawData", "data", output)
+	return output, nil
 }
 
-type SBMSRawData struct {
-	//Btn string
-	//Btp string
+const (
+	capacityUnitAmpHours = "Ah"
+	graphUnitAmps        = "A"
+	graphUnitWatts       = "W"
+)
+
+// decodeUnits reads s1, which holds the capacity unit, the graph unit and the model.
+// The html page pads the model with spaces, and an SBMS0 without s1 is assumed to be in Ah
+func decodeUnits(s1 []string) (capacityUnit, graphUnit, model string) {
+	capacityUnit = capacityUnitAmpHours
+	graphUnit = graphUnitAmps
+	if len(s1) > 0 && strings.TrimSpace(s1[0]) != "" {
+		capacityUnit = strings.TrimSpace(s1[0])
+	}
+	if len(s1) > 1 && strings.TrimSpace(s1[1]) != "" {
+		graphUnit = strings.TrimSpace(s1[1])
+	}
+	if len(s1) > 2 {
+		model = strings.TrimSpace(s1[2])
+	}
+	return capacityUnit, graphUnit, model
+}
+
+// averageSources are the graphs on the html page, in the order they appear in gsbms
+var averageSources = []string{"pv", "battery", "load", "dmppt"}
+
+// averageWindows are the windows of each graph, in the order they appear in gsbms
+var averageWindows = []string{"12h", "1h", "1m"}
+
+// decodeAverages reads the 12h, 1h and 1m averages of each graph, scaled like index.html
+// shows them: from mA to A, or from tenths of a watt to W when the graphs are shown in W
+func decodeAverages(gsbms []uint16, graphUnit string) []Average {
+	var averages []Average
+	for k, source := range averageSources {
+		for i, window := range averageWindows {
+			offset := ((k * len(averageWindows)) + i) * 3
+			if offset+3 > len(gsbms) {
+				return averages
+			}
+			value := dcmp(offset, 3, gsbms) / 1000
+			if graphUnit == graphUnitWatts {
+				value = dcmp(offset, 3, gsbms) / 10
+			}
+			averages = append(averages, Average{source: source, window: window, value: value})
+		}
+	}
+	return averages
+}
+
+const (
+	minCells = 3
+	maxCells = 8
+)
+
+// detectCellCount works out how many cells the battery has. The SBMS0 always
+// sends 8 cells, but on smaller packs the unused cells read nonsense, so
+// trailing cells outside half the configured minimum to 1.5 times the
+// configured maximum cell voltage are dropped
+func detectCellCount(cells []Cell, minMV, maxMV int) int {
+	count := len(cells)
+	for count > minCells {
+		mV := cells[count-1].mV
+		if mV*2 >= minMV && mV*2 <= maxMV*3 {
+			break
+		}
+		count--
+	}
+	return count
+}
+
+// dmpptLength is the number of runes in the dmppt block that carry data
+const dmpptLength = 54
 
-	//ELd string
-	//Ld string
+// hasDMPPT uses the same check as the SBMS0 html page; the DMPPT energy register
+// is either zero or overflowed when no DMPPT450 is attached
+func hasDMPPT(eA, dmppt []uint16) bool {
+	if len(dmppt) < dmpptLength || len(eA) < 4*6 {
+		return false
+	}
+	ah := dcmp(3*6, 6, eA)
+	return ah != 0 && ah < 416000000000
+}
 
-	//PV1 string
-	//PV2 string
+func decodeDMPPT(dmppt []uint16) *DMPPTData {
+	output := new(DMPPTData)
+	output.version = dcmp(0, 1, dmppt) / 10
+	output.voltage = dcmp(1, 3, dmppt)
 
-	//dmppt string
-	//gsbms string
-	//s1    string
+	output.channelCurrents = []float64{}
+	for i := 0; i < 6; i++ {
+		output.channelCurrents = append(output.channelCurrents, dcmp((i*3)+5, 3, dmppt))
+	}
 
+	output.pv1OutCurrent = dcmp(23, 3, dmppt)
+	output.pv2OutCurrent = dcmp(26, 3, dmppt)
+	output.internalTemperature = dcmp(48, 2, dmppt) - 40
+	output.temp235 = (dcmp(50, 2, dmppt) - 450) / 10
+	output.temp146 = (dcmp(52, 2, dmppt) - 450) / 10
+	return output
+}
+
+type SBMSRawData struct {
+	// history holds the graph buffers PV1, PV2, Btp, Btn, Ld and ELd
+	history map[string][]uint16
+
+	dmppt []uint16
 	eA    []uint16
 	eW    []uint16
+	gsbms []uint16
+	s1    []string
 	s2    []int64
 	sbms  []uint16
 	xsbms []uint16
 }
 
-var re = regexp.MustCompile(`var\s+(\w+)\s*=\s*(.*);`)
+// MissingVariableError is returned when rawData doesn't declare a variable we need
+type MissingVariableError struct {
+	Name string
+}
 
-func extractJSVariableLiteralValues(content []byte) map[string]string {
-	output := map[string]string{}
-	for _, line := range strings.Split(string(content), "\n") {
-		matches := re.FindAllStringSubmatch(line, -1)
-		for _, pair := range matches {
-			n := pair[1]
-			v := pair[2]
-			output[n] = v
-		}
-	}
-	return output
+func (e *MissingVariableError) Error() string {
+	return fmt.Sprintf("rawData is missing variable %s", e.Name)
 }
 
-func parseRawData(content []byte) (*SBMSRawData, error) {
-	output := new(SBMSRawData)
-	extracted := extractJSVariableLiteralValues(content)
+// ShortFieldError is returned when a variable in rawData is shorter than the data we read from it
+type ShortFieldError struct {
+	Name   string
+	Length int
+	Want   int
+}
 
-	output.eW = extractStrLiteral(extracted["eW"])
-	output.eA = extractStrLiteral(extracted["eA"])
-	output.sbms = extractStrLiteral(extracted["sbms"])
-	output.xsbms = extractStrLiteral(extracted["xsbms"])
+func (e *ShortFieldError) Error() string {
+	return fmt.Sprintf("rawData variable %s has length %d, want at least %d", e.Name, e.Length, e.Want)
+}
 
-	s2, err := extractIntArrayLiteral(extracted["s2"])
+// requiredFields are the variables that Decode reads, and how long they must be;
+// dmppt, gsbms, s1 and the graph buffers are optional and checked where they are read
+var requiredFields = []struct {
+	name   string
+	length int
+}{
+	{name: "sbms", length: 59},
+	{name: "xsbms", length: 11},
+	{name: "eW", length: 7 * 6},
+	{name: "eA", length: 7 * 6},
+}
+
+func parseRawData(content []byte, logger *slog.Logger) (*SBMSRawData, error) {
+	output := new(SBMSRawData)
+	variables, err := parseJSVariables(content)
 	if err != nil {
 		return nil, err
 	}
-	output.s2 = s2
+	if logger.Enabled(context.Background(), slog.LevelDebug) {
+		for name, v := range variables {
+			logger.Debug("rawData variable", "field", name, "value", v)
+		}
+	}
 
-	return output, nil
-}
+	for _, field := range requiredFields {
+		if _, ok := variables[field.name]; !ok {
+			return nil, &MissingVariableError{Name: field.name}
+		}
+	}
 
-func extractIntArrayLiteral(value string) ([]int64, error) {
-	var out []int64
-	escaped := strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
-	split := strings.Split(escaped, ",")
-	for _, v := range split {
-		parseInt, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
-		if err != nil {
+	for name, dst := range map[string]*[]uint16{
+		"eW":    &output.eW,
+		"eA":    &output.eA,
+		"sbms":  &output.sbms,
+		"xsbms": &output.xsbms,
+		"dmppt": &output.dmppt,
+		"gsbms": &output.gsbms,
+	} {
+		if *dst, err = stringVariable(variables, name); err != nil {
 			return nil, err
 		}
-		out = append(out, parseInt)
 	}
 
-	log.Printf("priority=%s", value)
-	log.Printf("escaped=%s", escaped)
-	log.Printf("split=%#+v", split)
-	log.Printf("out=%#+v", out)
+	for _, field := range requiredFields {
+		v := variables[field.name]
+		if len(v.str) < field.length {
+			return nil, &ShortFieldError{Name: field.name, Length: len(v.str), Want: field.length}
+		}
+	}
 
-	return out, nil
-}
+	output.history = map[string][]uint16{}
+	for _, name := range historySeries {
+		if output.history[name], err = stringVariable(variables, name); err != nil {
+			return nil, err
+		}
+	}
+
+	if s1, ok := variables["s1"]; ok {
+		if output.s1, err = s1.asStringArray(); err != nil {
+			return nil, err
+		}
+	}
 
-func extractStrLiteral(value string) []uint16 {
-	stripped := strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(value), "\""), "\"")
-	// replace double backslash with a single backslash
-	escape1 := strings.ReplaceAll(stripped, "\\\\", "\\")
-	// replace backslash followed by a double quote with just a double quote
-	escape2 := strings.ReplaceAll(escape1, "\\\"", "\"")
-	runes := utf16.Encode([]rune(escape2))
+	s2, ok := variables["s2"]
+	if !ok {
+		return nil, &MissingVariableError{Name: "s2"}
+	}
+	if output.s2, err = s2.asIntArray(); err != nil {
+		return nil, err
+	}
+	if len(output.s2) < maxCells {
+		return nil, &ShortFieldError{Name: "s2", Length: len(output.s2), Want: maxCells}
+	}
 
-	log.Printf("priority=%s", value)
-	log.Printf("stripped=%s", stripped)
-	log.Printf("escaped=%s", escape2)
-	log.Printf("runes=%v", runes)
+	return output, nil
+}
 
-	return runes
+// stringVariable returns the value of a string variable, or nothing if it wasn't declared
+func stringVariable(variables map[string]jsValue, name string) ([]uint16, error) {
+	v, ok := variables[name]
+	if !ok {
+		return nil, nil
+	}
+	return v.asString()
 }
 
+// SBMS0Collector exports the rawData polled from one SBMS0 as const metrics,
+// so collecting shares no state between scrapes or devices
 type SBMS0Collector struct {
-	url string
+	poller *Poller[*SBMSData]
+	energy *energyTracker
+	scrape scrapeDescs
+	descs  rawDataDescs
 }
 type SBMS0SystemCollector struct {
-	url string
+	poller *Poller[[]SystemTaskInfo]
+	scrape scrapeDescs
+	descs  []*prometheus.Desc
+}
+
+// NewSBMS0Collector exports the rawData polled by poller as metrics named prefix_*,
+// with labels added to every series so that several devices can be registered together;
+// the energy counters are kept by energy, which outlives the collector across reloads
+func NewSBMS0Collector(poller *Poller[*SBMSData], energy *energyTracker, prefix string, labels prometheus.Labels) SBMS0Collector {
+	return SBMS0Collector{poller: poller, energy: energy, scrape: newScrapeDescs(prefix, labels), descs: newRawDataDescs(prefix, labels)}
+}
+
+func NewSBMS0SystemCollector(poller *Poller[[]SystemTaskInfo], prefix string, labels prometheus.Labels) SBMS0SystemCollector {
+	return SBMS0SystemCollector{poller: poller, scrape: newScrapeDescs(prefix, labels), descs: newSystemTaskDescs(prefix, labels)}
 }
 
 func (cc SBMS0Collector) Describe(ch chan<- *prometheus.Desc) {
-	prometheus.DescribeByCollect(cc, ch)
+	cc.scrape.describe(ch)
+	cc.descs.describe(ch)
 }
 
 func (cc SBMS0SystemCollector) Describe(ch chan<- *prometheus.Desc) {
-	prometheus.DescribeByCollect(cc, ch)
+	cc.scrape.describe(ch)
+	for _, desc := range cc.descs {
+		ch <- desc
+	}
 }
 
-// Collect collects the rawData endpoint directly from the SBMS0 device
+// Collect exports the latest rawData polled from the SBMS0 device
 //
-// Note that Collect could be called concurrently, so we depend on
-// the /rawData endpoint to be concurrency-safe.
+// Note that Collect could be called concurrently, but it only reads
+// the snapshot held by the poller and never calls the device itself;
+// the requests that do call it are coalesced by a flightGroup.
 func (cc SBMS0Collector) Collect(ch chan<- prometheus.Metric) {
-	reqsCount.Inc()
-	resp, err := http.Get(cc.url)
-	if err != nil {
-		log.Fatalln(err)
+	result := cc.poller.Result()
+	exportPollResult(ch, cc.scrape, result)
+	if result.HasLatest {
+		// the exporter observes every poll before publishing it, this only catches up pollers it doesn't publish
+		cc.energy.observe(result.Latest)
+		cc.export(ch, result.Latest)
 	}
-	b, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatalln(err)
-	}
-	respBytes.Add(float64(len(b)))
-
-	log.Printf("resp is\n%s\n", string(b))
-	response := decodeResponse(b)
-
-	ch <- respBytes
-	ch <- reqsCount
-
-	setAndExport(ch, Cell1Voltage, float64(response.cells[0].mV))
-	setAndExport(ch, Cell2Voltage, float64(response.cells[1].mV))
-	setAndExport(ch, Cell3Voltage, float64(response.cells[2].mV))
-	setAndExport(ch, Cell4Voltage, float64(response.cells[3].mV))
-	setAndExport(ch, Cell5Voltage, float64(response.cells[4].mV))
-	setAndExport(ch, Cell6Voltage, float64(response.cells[5].mV))
-	setAndExport(ch, Cell7Voltage, float64(response.cells[6].mV))
-	setAndExport(ch, Cell8Voltage, float64(response.cells[7].mV))
-
-	setAndExport(ch, Cell1Balancing, boolToFloat(response.cells[0].isBalancing))
-	setAndExport(ch, Cell2Balancing, boolToFloat(response.cells[1].isBalancing))
-	setAndExport(ch, Cell3Balancing, boolToFloat(response.cells[2].isBalancing))
-	setAndExport(ch, Cell4Balancing, boolToFloat(response.cells[3].isBalancing))
-	setAndExport(ch, Cell5Balancing, boolToFloat(response.cells[4].isBalancing))
-	setAndExport(ch, Cell6Balancing, boolToFloat(response.cells[5].isBalancing))
-	setAndExport(ch, Cell7Balancing, boolToFloat(response.cells[6].isBalancing))
-	setAndExport(ch, Cell8Balancing, boolToFloat(response.cells[7].isBalancing))
-
-	setAndExport(ch, TempInt, response.internalTemperature)
-	setAndExport(ch, TempExt, response.externalTemperature)
-
-	setAndExport(ch, Soc, response.soc)
-
-	setAndExport(ch, batteryEnergyWh, response.batteryEnergyWh)
-	setAndExport(ch, batteryEnergyAh, response.batteryEnergyAh)
-	setAndExport(ch, pV1EnergyWh, response.pV1EnergyWh)
-	setAndExport(ch, pV1EnergyAh, response.pV1EnergyAh)
-	setAndExport(ch, pV2EnergyWh, response.pV2EnergyWh)
-	setAndExport(ch, pV2EnergyAh, response.pV2EnergyAh)
-	setAndExport(ch, loadEnergyWh, response.loadEnergyWh)
-	setAndExport(ch, loadEnergyAh, response.loadEnergyAh)
-	setAndExport(ch, extLoadEnergyWh, response.extLoadEnergyWh)
-	setAndExport(ch, extLoadEnergyAh, response.extLoadEnergyAh)
-	setAndExport(ch, dmpptEnergyWh, response.dmpptEnergyWh)
-	setAndExport(ch, dmpptEnergyAh, response.dmpptEnergyAh)
-
-	setAndExport(ch, cellType, response.cellType)
-	setAndExport(ch, capacity, response.capacity)
-	setAndExport(ch, status, response.status)
-
-	setAndExport(ch, BatteryCurrent, response.batteryCurrent)
-	setAndExport(ch, BatteryPower, response.batteryPower)
-	setAndExport(ch, BatteryVoltage, response.batteryVoltage)
-	setAndExport(ch, CurrentPv1, response.pv1Current)
-	setAndExport(ch, CurrentPv2, response.pv2Current)
-	setAndExport(ch, CurrentExtLoad, response.externalCurrent)
-
-	setAndExport(ch, Ad2, float64(response.adc2))
-	setAndExport(ch, Ad3, float64(response.adc3))
-	setAndExport(ch, Ad4, float64(response.adc4))
-	setAndExport(ch, Heat1, float64(response.heat1))
-	setAndExport(ch, Heat2, float64(response.heat2))
-
-	setAndExport(ch, Dfet, boolToFloat(response.flags.DischargeFETActive))
-	setAndExport(ch, Eoc, boolToFloat(response.flags.EndOfCharge))
-	setAndExport(ch, Cfet, boolToFloat(response.flags.ChargeFETActive))
-	setAndExport(ch, Eccf, boolToFloat(response.flags.EEPROMFail))
-	setAndExport(ch, Lvc, boolToFloat(response.flags.LowVoltageCell))
-	setAndExport(ch, Open, boolToFloat(response.flags.OpenCellWire))
-	setAndExport(ch, Celf, boolToFloat(response.flags.CellFail))
-	setAndExport(ch, Dsc, boolToFloat(response.flags.DischargeShortCircuit))
-	setAndExport(ch, Doc, boolToFloat(response.flags.DischargeOverCurrent))
-	setAndExport(ch, Coc, boolToFloat(response.flags.ChargeOverCurrent))
-	setAndExport(ch, Iot, boolToFloat(response.flags.InternalOverTemperature))
-	setAndExport(ch, Uvlk, boolToFloat(response.flags.UnderVoltageLock))
-	setAndExport(ch, Uv, boolToFloat(response.flags.UnderVoltage))
-	setAndExport(ch, Ovlk, boolToFloat(response.flags.OverVoltageLock))
-	setAndExport(ch, Ov, boolToFloat(response.flags.OverVoltage))
 }
 
-func (cc SBMS0SystemCollector) Collect(ch chan<- prometheus.Metric) {
-	resp, err := http.Get(cc.url)
-	if err != nil {
-		log.Fatalln(err)
+func (cc SBMS0Collector) export(ch chan<- prometheus.Metric, response *SBMSData) {
+	// channels the model doesn't have are left out, rather than reading zero
+	for i, g := range rawDataGauges {
+		if g.has != nil && !g.has(response) {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(cc.descs.gauges[i], prometheus.GaugeValue, g.value(response))
 	}
-	b, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatalln(err)
+	cc.energy.export(ch, cc.descs.energy, response)
+
+	// cells that don't exist on this battery are left out
+	for i, cell := range response.cells {
+		ch <- prometheus.MustNewConstMetric(cc.descs.cellVoltage, prometheus.GaugeValue, float64(cell.mV), strconv.Itoa(i+1))
+		ch <- prometheus.MustNewConstMetric(cc.descs.cellBalancing, prometheus.GaugeValue, boolToFloat(cell.isBalancing), strconv.Itoa(i+1))
 	}
-	log.Printf("debug resp is\n%s\n", string(b))
-	data := decodeDebugResponse(b)
 
-	// reset all the labels from last time
-	systemTaskPriority.Reset()
-	systemTaskRunTime.Reset()
-	systemTaskRunTimePercent.Reset()
-	systemTaskState.Reset()
+	ch <- prometheus.MustNewConstMetric(cc.descs.info, prometheus.GaugeValue, 1, response.model, response.capacityUnit, response.graphUnit)
+
+	for _, a := range response.averages {
+		desc := cc.descs.averageCurrent
+		if response.graphUnit == graphUnitWatts {
+			desc = cc.descs.averagePower
+		}
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, a.value, a.source, a.window)
+	}
 
+	if response.dmppt != nil {
+		for i, current := range response.dmppt.channelCurrents {
+			ch <- prometheus.MustNewConstMetric(cc.descs.dmpptChannelCurrent, prometheus.GaugeValue, current, strconv.Itoa(i+1))
+		}
+	}
+}
+
+func (cc SBMS0SystemCollector) Collect(ch chan<- prometheus.Metric) {
+	result := cc.poller.Result()
+	exportPollResult(ch, cc.scrape, result)
+	if result.HasLatest {
+		cc.export(ch, result.Latest)
+	}
+}
+
+func (cc SBMS0SystemCollector) export(ch chan<- prometheus.Metric, data []SystemTaskInfo) {
 	for _, d := range data {
-		setAndExport(ch, systemTaskPriority.WithLabelValues(d.name), d.priority)
-		setAndExport(ch, systemTaskRunTime.WithLabelValues(d.name), d.runTimeCounter)
-		setAndExport(ch, systemTaskRunTimePercent.WithLabelValues(d.name), d.runTimePercent)
-		setAndExport(ch, systemTaskState.WithLabelValues(d.name), d.state)
+		for i, g := range systemTaskGauges {
+			ch <- prometheus.MustNewConstMetric(cc.descs[i], prometheus.GaugeValue, g.value(d), d.name)
+		}
 	}
 }
 
+// decodeDebug decodes the debug endpoint, which can't fail as unknown rows are skipped
+func decodeDebug(b []byte) ([]SystemTaskInfo, error) {
+	return decodeDebugResponse(b), nil
+}
+
 func taskStateToValue(state string) float64 {
 	// https://github.com/armageddon421/electrodacus-esp32/blob/1d8f5ec6a86613d09cdd9cef91cffe9b9a56a0bd/src/main.cpp#L697C1-L698C1
 	states := map[string]float64{
@@ -631,18 +821,12 @@ func taskStateToValue(state string) float64 {
 	return value
 }
 
-func setAndExport(ch chan<- prometheus.Metric, gauge prometheus.Gauge, value float64) {
-	gauge.Set(value)
-	ch <- gauge
-}
-
 func parseRawURL(raw string) (*url.URL, error) {
 	u, err := url.ParseRequestURI(raw)
 	if err != nil || u.Host == "" {
 		u, repErr := url.ParseRequestURI("http://" + raw)
 		if repErr != nil {
-			fmt.Printf("Could not parse raw url: %s, error: %v", raw, err)
-			return nil, err
+			return nil, fmt.Errorf("could not parse url %q: %w", raw, repErr)
 		}
 		return u, nil
 	}
@@ -678,40 +862,57 @@ func getDebugURL(src string) (string, error) {
 	return p.String(), nil
 }
 
-func shouldEnableDefaultCollectors() bool {
-	v := os.Getenv("ENABLE_DEFAULT_COLLECTORS")
-	if slices.Contains([]string{"t", "1", "true", "yes"}, strings.ToLower(strings.TrimSpace(v))) {
-		return true
-	}
-	return false
-}
-
 func main() {
-	log.Println("starting")
+	if len(os.Args) > 1 && os.Args[1] == "backfill" {
+		if err := runBackfill(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	u, err := getURL(os.Getenv("URL"))
-	debugURL, err := getDebugURL(os.Getenv("URL"))
+	config, checkOnly, err := loadConfig(os.Args[1:], os.Getenv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logLevel := new(slog.LevelVar)
+	logger, err := newLogger(os.Stderr, config.Log, logLevel)
 	if err != nil {
 		log.Fatal(err)
 	}
+	slog.SetDefault(logger)
+	if checkOnly {
+		slog.Info("config is valid")
+		return
+	}
 
-	reg := prometheus.NewPedanticRegistry()
-	systemMetricsReg := prometheus.NewPedanticRegistry()
+	slog.Info("starting", "listen_address", config.ListenAddress, "devices", len(config.Devices))
 
-	if shouldEnableDefaultCollectors() {
-		reg.MustRegister(
-			collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
-			collectors.NewGoCollector(),
-		)
+	exporter, err := NewExporter(func() (*Config, error) {
+		config, _, err := loadConfig(os.Args[1:], os.Getenv)
+		return config, err
+	}, logLevel)
+	if err != nil {
+		slog.Error("could not start", "err", err)
+		os.Exit(1)
 	}
 
-	reg.MustRegister(SBMS0Collector{url: u})
-	systemMetricsReg.MustRegister(SBMS0SystemCollector{url: debugURL})
-
-	handler := promhttp.InstrumentMetricHandler(reg, promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
-	systemMetricsHandler := promhttp.InstrumentMetricHandler(systemMetricsReg, promhttp.HandlerFor(systemMetricsReg, promhttp.HandlerOpts{}))
+	// the energy state is saved on the way out
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-term
+		exporter.Close()
+		os.Exit(0)
+	}()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			_ = exporter.Reload()
+		}
+	}()
 
-	http.Handle("/metrics", handler)
-	http.Handle("/metrics_system", systemMetricsHandler)
-	log.Fatal(http.ListenAndServe(":9000", nil))
+	slog.Error("stopped", "err", http.ListenAndServe(config.ListenAddress, exporter))
+	os.Exit(1)
 }
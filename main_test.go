@@ -59,9 +59,15 @@ func TestGetURLWorksWithHostnameAndPath(t *testing.T) {
 	assert.Equal(t, "https://sbms.local/", u)
 }
 
+func TestGetURLFailsForInvalidURL(t *testing.T) {
+	_, e := getURL("192.168.1.1:port")
+	assert.ErrorContains(t, e, `could not parse url "192.168.1.1:port"`)
+}
+
 func TestRawData6(t *testing.T) {
 	content := readFileContent(t, "./__source__/rawData6")
-	out := decodeResponse(content)
+	out, err := Decode(content)
+	assert.Nil(t, err)
 	log.Printf("%+#v", out)
 	assert.Equal(t, &SBMSData{ts: "2024-02-20T13:32:56",
 		soc:            69,
@@ -121,12 +127,31 @@ func TestRawData6(t *testing.T) {
 		cellType:        1,
 		capacity:        280,
 		status:          20480,
+		model:           "SBMS0",
+		layout:          modelLayouts["SBMS0"],
+		capacityUnit:    "Ah",
+		graphUnit:       "A",
+		averages: []Average{
+			{source: "pv", window: "12h", value: 34.62},
+			{source: "pv", window: "1h", value: 0.042},
+			{source: "pv", window: "1m", value: 0.044},
+			{source: "battery", window: "12h", value: 51.788},
+			{source: "battery", window: "1h", value: 6.681},
+			{source: "battery", window: "1m", value: 6.378},
+			{source: "load", window: "12h", value: 52.221},
+			{source: "load", window: "1h", value: 6.694},
+			{source: "load", window: "1m", value: 6.391},
+			{source: "dmppt", window: "12h", value: 0},
+			{source: "dmppt", window: "1h", value: 0},
+			{source: "dmppt", window: "1m", value: 0},
+		},
 	}, out)
 }
 
 func TestRawData7(t *testing.T) {
 	content := readFileContent(t, "./__source__/rawData7")
-	out := decodeResponse(content)
+	out, err := Decode(content)
+	assert.Nil(t, err)
 	log.Printf("%+#v", out)
 	assert.Equal(t, &SBMSData{
 		ts:             "2024-03-03T07:44:24",
@@ -187,12 +212,31 @@ func TestRawData7(t *testing.T) {
 		cellType:        1,
 		capacity:        280,
 		status:          20480,
+		model:           "SBMS0",
+		layout:          modelLayouts["SBMS0"],
+		capacityUnit:    "Ah",
+		graphUnit:       "A",
+		averages: []Average{
+			{source: "pv", window: "12h", value: 33.846},
+			{source: "pv", window: "1h", value: 5.98},
+			{source: "pv", window: "1m", value: 1.488},
+			{source: "battery", window: "12h", value: 36.875},
+			{source: "battery", window: "1h", value: 39.533},
+			{source: "battery", window: "1m", value: 5.609},
+			{source: "load", window: "12h", value: 38.75},
+			{source: "load", window: "1h", value: 41.42},
+			{source: "load", window: "1m", value: 6.994},
+			{source: "dmppt", window: "12h", value: 0},
+			{source: "dmppt", window: "1h", value: 0},
+			{source: "dmppt", window: "1m", value: 0},
+		},
 	}, out)
 }
 
 func TestRawData8(t *testing.T) {
 	content := readFileContent(t, "./__source__/rawData8")
-	out := decodeResponse(content)
+	out, err := Decode(content)
+	assert.Nil(t, err)
 	log.Printf("%+#v", out)
 	assert.Equal(t, &SBMSData{
 		ts:             "2024-03-03T06:44:24",
@@ -254,12 +298,31 @@ func TestRawData8(t *testing.T) {
 		cellType:        1,
 		capacity:        280,
 		status:          20480,
+		model:           "SBMS0",
+		layout:          modelLayouts["SBMS0"],
+		capacityUnit:    "Ah",
+		graphUnit:       "A",
+		averages: []Average{
+			{source: "pv", window: "12h", value: 33.846},
+			{source: "pv", window: "1h", value: 9.438},
+			{source: "pv", window: "1m", value: 5.618},
+			{source: "battery", window: "12h", value: 30.928},
+			{source: "battery", window: "1h", value: 2.67},
+			{source: "battery", window: "1m", value: 1.261},
+			{source: "load", window: "12h", value: 25.082},
+			{source: "load", window: "1h", value: 7.156},
+			{source: "load", window: "1m", value: 5.018},
+			{source: "dmppt", window: "12h", value: 0},
+			{source: "dmppt", window: "1h", value: 0},
+			{source: "dmppt", window: "1m", value: 0},
+		},
 	}, out)
 }
 
 func TestRawData9(t *testing.T) {
 	content := readFileContent(t, "./__source__/rawData9")
-	out := decodeResponse(content)
+	out, err := Decode(content)
+	assert.Nil(t, err)
 	log.Printf("%+#v", out)
 	assert.Equal(t, &SBMSData{ts: "2024-07-10T13:42:12",
 		soc:            41,
@@ -319,13 +382,33 @@ func TestRawData9(t *testing.T) {
 		dmpptEnergyAh:   0,
 		cellType:        1,
 		capacity:        280,
-		status:          4100},
+		status:          4100,
+		model:           "SBMS0",
+		layout:          modelLayouts["SBMS0"],
+		capacityUnit:    "Ah",
+		graphUnit:       "A",
+		averages: []Average{
+			{source: "pv", window: "12h", value: 25.664},
+			{source: "pv", window: "1h", value: 0.042},
+			{source: "pv", window: "1m", value: 0.031},
+			{source: "battery", window: "12h", value: 32.372},
+			{source: "battery", window: "1h", value: 3.493},
+			{source: "battery", window: "1m", value: 0.723},
+			{source: "load", window: "12h", value: 39.921},
+			{source: "load", window: "1h", value: 3.502},
+			{source: "load", window: "1m", value: 0},
+			{source: "dmppt", window: "12h", value: 0},
+			{source: "dmppt", window: "1h", value: 0},
+			{source: "dmppt", window: "1m", value: 0},
+		},
+	},
 		out)
 }
 
 func TestRawData10(t *testing.T) {
 	content := readFileContent(t, "./__source__/rawData10")
-	out := decodeResponse(content)
+	out, err := Decode(content)
+	assert.Nil(t, err)
 	log.Printf("%+#v", out)
 
 	// 2024/08/18 08:56:44 offset=24 count=2 sum=1360.000000 debug=rune 25 is 121 is y is 86.000000; rune 24 is 49 is 1 is 1274.000000;
@@ -386,13 +469,33 @@ func TestRawData10(t *testing.T) {
 		dmpptEnergyAh:   0,
 		cellType:        1,
 		capacity:        280,
-		status:          20480},
+		status:          20480,
+		model:           "SBMS0",
+		layout:          modelLayouts["SBMS0"],
+		capacityUnit:    "Ah",
+		graphUnit:       "A",
+		averages: []Average{
+			{source: "pv", window: "12h", value: 32.322},
+			{source: "pv", window: "1h", value: 0.045},
+			{source: "pv", window: "1m", value: 0.047},
+			{source: "battery", window: "12h", value: 26.268},
+			{source: "battery", window: "1h", value: 6.936},
+			{source: "battery", window: "1m", value: 6.855},
+			{source: "load", window: "12h", value: 41.127},
+			{source: "load", window: "1h", value: 6.936},
+			{source: "load", window: "1m", value: 6.867},
+			{source: "dmppt", window: "12h", value: 0},
+			{source: "dmppt", window: "1h", value: 0},
+			{source: "dmppt", window: "1m", value: 0},
+		},
+	},
 		out)
 }
 
 func TestRawData11(t *testing.T) {
 	content := readFileContent(t, "./__source__/rawData11")
-	out := decodeResponse(content)
+	out, err := Decode(content)
+	assert.Nil(t, err)
 	log.Printf("%+#v", out)
 
 	// 2024/08/18 08:57:21 offset=24 count=2 sum=150.000000 debug=rune 25 is 94 is ^ is 59.000000; rune 24 is 36 is $ is 91.000000;
@@ -453,6 +556,24 @@ func TestRawData11(t *testing.T) {
 		cellType:        1,
 		capacity:        280,
 		status:          20480,
+		model:           "SBMS0",
+		layout:          modelLayouts["SBMS0"],
+		capacityUnit:    "Ah",
+		graphUnit:       "A",
+		averages: []Average{
+			{source: "pv", window: "12h", value: 32.322},
+			{source: "pv", window: "1h", value: 0.045},
+			{source: "pv", window: "1m", value: 0.051},
+			{source: "battery", window: "12h", value: 26.268},
+			{source: "battery", window: "1h", value: 6.936},
+			{source: "battery", window: "1m", value: 7.09},
+			{source: "load", window: "12h", value: 41.127},
+			{source: "load", window: "1h", value: 6.936},
+			{source: "load", window: "1m", value: 7.103},
+			{source: "dmppt", window: "12h", value: 0},
+			{source: "dmppt", window: "1h", value: 0},
+			{source: "dmppt", window: "1m", value: 0},
+		},
 	},
 		out)
 }
@@ -477,3 +598,75 @@ func TestDebug1(t *testing.T) {
 		{name: "sys_evt", state: 2, priority: 20, runTimeCounter: 1809, runTimePercent: 0},
 	}, out)
 }
+
+func TestRawData12WithDMPPT(t *testing.T) {
+	content := readFileContent(t, "./__source__/rawData12")
+	out, err := Decode(content)
+	assert.Nil(t, err)
+	log.Printf("%+#v", out)
+
+	// rawData12 is synthetic: rawData6 with a made-up dmppt block, see __source__/README.md
+	assert.Equal(t, 123.456, out.dmpptEnergyAh)
+	assert.Equal(t, 3300.0, out.dmpptEnergyWh)
+	assert.Equal(t, &DMPPTData{
+		version:             1.2,
+		voltage:             27150,
+		channelCurrents:     []float64{1200, 1180, 1210, 0, 0, 0},
+		pv1OutCurrent:       3590,
+		pv2OutCurrent:       0,
+		temp235:             25.3,
+		temp146:             24.8,
+		internalTemperature: 35,
+	}, out.dmppt)
+}
+
+func TestRawDataWithoutDMPPT(t *testing.T) {
+	for _, path := range []string{"./__source__/rawData6", "./__source__/rawData3"} {
+		content := readFileContent(t, path)
+		out, err := Decode(content)
+		assert.Nil(t, err)
+		assert.Nil(t, out.dmppt, path)
+	}
+}
+
+func TestDecodeAverages(t *testing.T) {
+	// 91 is 91 mA in A, or 9.1 W in W
+	out := decodeAverages([]uint16{'#', '$', '#'}, graphUnitAmps)
+	assert.Equal(t, []Average{{source: "pv", window: "12h", value: 0.091}}, out)
+	out = decodeAverages([]uint16{'#', '$', '#'}, graphUnitWatts)
+	assert.Equal(t, []Average{{source: "pv", window: "12h", value: 9.1}}, out)
+}
+
+func TestDecodeUnits(t *testing.T) {
+	capacityUnit, graphUnit, model := decodeUnits([]string{"Wh", "W", "SBMS0  "})
+	assert.Equal(t, "Wh", capacityUnit)
+	assert.Equal(t, "W", graphUnit)
+	assert.Equal(t, "SBMS0", model)
+
+	capacityUnit, graphUnit, model = decodeUnits(nil)
+	assert.Equal(t, "Ah", capacityUnit)
+	assert.Equal(t, "A", graphUnit)
+	assert.Equal(t, "", model)
+}
+
+func TestRawData15FourCells(t *testing.T) {
+	content := readFileContent(t, "./__source__/rawData15")
+	out, err := Decode(content)
+	assert.Nil(t, err)
+
+	// rawData6 with cells 5 to 8 not connected
+	assert.Equal(t, []Cell{
+		{mV: 3310, isBalancing: false},
+		{mV: 3313, isBalancing: false},
+		{mV: 3312, isBalancing: false},
+		{mV: 3311, isBalancing: false},
+	}, out.cells)
+	assert.Equal(t, float64(13246), out.batteryVoltage)
+}
+
+func TestDetectCellCount(t *testing.T) {
+	cells := []Cell{{mV: 3300}, {mV: 3300}, {mV: 3300}, {mV: 3300}, {mV: 9000}, {mV: 0}, {mV: 0}, {mV: 0}}
+	assert.Equal(t, 4, detectCellCount(cells, 2500, 3750))
+	// never less than 3 cells, even if the whole battery reads nothing
+	assert.Equal(t, 3, detectCellCount(make([]Cell, 8), 2500, 3750))
+}
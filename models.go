@@ -0,0 +1,49 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+)
+
+// ModelLayout describes which of the channels in rawData a model actually has.
+// All models serve the same rawData page, but the fields of a missing channel are left at zero
+type ModelLayout struct {
+	pv2     bool
+	extLoad bool
+	dmppt   bool
+}
+
+const defaultModel = "SBMS0"
+
+// Only the SBMS0 and SBMS100 layouts are backed by captures (rawData6 and rawData3). The
+// SBMS120 and SBMS40 are said by their datasheets to lack channels of the SBMS0, but that
+// hasn't been checked against a unit, so until a capture shows which fields they leave at
+// zero they export every channel like the SBMS0, rather than hide readings on a guess
+var modelLayouts = map[string]ModelLayout{
+	// PV1 and PV2 charge inputs, the external load shunt, and a DMPPT450 via the expansion port
+	"SBMS0": {pv2: true, extLoad: true, dmppt: true},
+	// PV1 and PV2 charge inputs, with the load on the internal shunt
+	"SBMS100": {pv2: true},
+	"SBMS120": {pv2: true, extLoad: true, dmppt: true},
+	"SBMS40":  {pv2: true, extLoad: true, dmppt: true},
+}
+
+// layoutFor returns the layout of a model and whether it's known, falling back to the SBMS0 for unknown models
+func layoutFor(model string) (ModelLayout, bool) {
+	layout, ok := modelLayouts[model]
+	if !ok {
+		return modelLayouts[defaultModel], false
+	}
+	return layout, true
+}
+
+// warnedModels are the unknown models already warned about, so a device doesn't warn on every poll
+var warnedModels sync.Map
+
+func warnUnknownModel(logger *slog.Logger, model string) {
+	if _, warned := warnedModels.LoadOrStore(model, true); warned {
+		logger.Debug("unknown model", "model", model, "assuming", defaultModel)
+		return
+	}
+	logger.Warn("unknown model", "model", model, "assuming", defaultModel)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func gatherMetricNames(t *testing.T, path string) []string {
+	device := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(readFileContent(t, path))
+	}))
+	defer device.Close()
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewSBMS0Collector(polledOnce(device.URL, Decode), newEnergyTracker(), defaultMetricPrefix, nil))
+	families, err := reg.Gather()
+	assert.Nil(t, err)
+
+	var names []string
+	for _, f := range families {
+		names = append(names, f.GetName())
+	}
+	return names
+}
+
+// the SBMS120 and SBMS40 export every channel until a capture tells which ones they lack
+func TestRawData13SBMS120(t *testing.T) {
+	out, err := Decode(readFileContent(t, "./__source__/rawData13"))
+	assert.Nil(t, err)
+	assert.Equal(t, "SBMS120", out.model)
+	assert.NotEqual(t, float64(0), out.externalCurrent)
+	assert.Equal(t, float64(39), out.pv1Current)
+
+	names := gatherMetricNames(t, "./__source__/rawData13")
+	assert.Contains(t, names, "sbms_pv2_current")
+	assert.Contains(t, names, "sbms_ext_current")
+	assert.Contains(t, names, "sbms_energy_ext_load_wh_total")
+}
+
+func TestRawData14SBMS40(t *testing.T) {
+	out, err := Decode(readFileContent(t, "./__source__/rawData14"))
+	assert.Nil(t, err)
+	assert.Equal(t, "SBMS40", out.model)
+	assert.NotEqual(t, float64(0), out.externalCurrent)
+	assert.Equal(t, float64(39), out.pv1Current)
+
+	names := gatherMetricNames(t, "./__source__/rawData14")
+	assert.Contains(t, names, "sbms_pv1_current")
+	assert.Contains(t, names, "sbms_pv2_current")
+	assert.Contains(t, names, "sbms_energy_pv2_wh_total")
+	assert.Contains(t, names, "sbms_ext_current")
+}
+
+func TestRawData3SBMS100(t *testing.T) {
+	out, err := Decode(readFileContent(t, "./__source__/rawData3"))
+	assert.Nil(t, err)
+	assert.Equal(t, "SBMS100", out.model)
+	assert.Nil(t, out.dmppt)
+	assert.Equal(t, float64(0), out.externalCurrent)
+}
+
+func TestRawData6SBMS0(t *testing.T) {
+	names := gatherMetricNames(t, "./__source__/rawData6")
+	assert.Contains(t, names, "sbms_pv2_current")
+	assert.Contains(t, names, "sbms_ext_current")
+	// the DMPPT registers read zero without a DMPPT450
+	assert.NotContains(t, names, "sbms_energy_dmppt_wh_total")
+	assert.Contains(t, gatherMetricNames(t, "./__source__/rawData12"), "sbms_energy_dmppt_wh_total")
+}
+
+// TestDMPPTEnergyOverflow reads the overflowed DMPPT registers of rawData3 as an SBMS0's
+func TestDMPPTEnergyOverflow(t *testing.T) {
+	content := strings.Replace(string(readFileContent(t, "./__source__/rawData3")), "'SBMS100'", "'SBMS0  '", 1)
+	out, err := Decode([]byte(content))
+	assert.Nil(t, err)
+	assert.Equal(t, "SBMS0", out.model)
+	assert.Nil(t, out.dmppt)
+	assert.Equal(t, float64(0), out.dmpptEnergyAh)
+	assert.Equal(t, float64(0), out.dmpptEnergyWh)
+}
+
+func TestLayoutForUnknownModel(t *testing.T) {
+	layout, known := layoutFor("SBMS999")
+	assert.Equal(t, modelLayouts["SBMS0"], layout)
+	assert.False(t, known)
+}
+
+func TestUnknownModelWarnsOnce(t *testing.T) {
+	b := bytes.Replace(readFileContent(t, "./__source__/rawData6"), []byte("'SBMS0  '"), []byte("'SBMS77 '"), 1)
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+
+	for i := 0; i < 3; i++ {
+		out, err := decodeRawData(b, logger)
+		assert.Nil(t, err)
+		assert.Equal(t, "SBMS77", out.model)
+		assert.Equal(t, modelLayouts["SBMS0"], out.layout)
+	}
+	assert.Equal(t, 1, strings.Count(buf.String(), "unknown model"))
+}
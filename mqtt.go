@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"log/slog"
+	"net/url"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMQTTTopicPrefix     = "sbms"
+	defaultMQTTDiscoveryPrefix = "homeassistant"
+	mqttPublishTimeout         = 10 * time.Second
+	mqttConnectRetryInterval   = 10 * time.Second
+	mqttOnline                 = "online"
+	mqttOffline                = "offline"
+)
+
+// MQTTSinkConfig publishes every poll to an MQTT broker, with Home Assistant discovery
+type MQTTSinkConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Broker is e.g. tcp://localhost:1883, or ssl:// for TLS
+	Broker   string `yaml:"broker"`
+	ClientID string `yaml:"client_id"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// TopicPrefix is where the readings go, as <topic_prefix>/<device>/state and /tasks
+	TopicPrefix string `yaml:"topic_prefix"`
+	QoS         byte   `yaml:"qos"`
+	Retain      bool   `yaml:"retain"`
+	// Discovery publishes Home Assistant discovery configs under DiscoveryPrefix
+	Discovery       bool   `yaml:"discovery"`
+	DiscoveryPrefix string `yaml:"discovery_prefix"`
+}
+
+func defaultMQTTSinkConfig() MQTTSinkConfig {
+	return MQTTSinkConfig{
+		ClientID:        "sbms_exporter",
+		TopicPrefix:     defaultMQTTTopicPrefix,
+		Discovery:       true,
+		DiscoveryPrefix: defaultMQTTDiscoveryPrefix,
+	}
+}
+
+func (c MQTTSinkConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.Broker == "" {
+		return errors.New("mqtt broker is empty")
+	}
+	if _, err := url.Parse(c.Broker); err != nil {
+		return fmt.Errorf("mqtt broker: %w", err)
+	}
+	if c.TopicPrefix == "" {
+		return errors.New("mqtt topic_prefix is empty")
+	}
+	if c.QoS > 2 {
+		return fmt.Errorf("mqtt qos must be 0, 1 or 2, not %d", c.QoS)
+	}
+	if c.Discovery && c.DiscoveryPrefix == "" {
+		return errors.New("mqtt discovery_prefix is empty")
+	}
+	return nil
+}
+
+// MQTTSink publishes the readings of each device as one JSON object to <topic_prefix>/<device>/state,
+// and the task table of the debug endpoint to <topic_prefix>/<device>/tasks
+type MQTTSink struct {
+	config MQTTSinkConfig
+	client mqtt.Client
+	// energy finds the energy totals of a device, which are published instead of the registers
+	energy func(device DeviceConfig) *energyTracker
+	queue  *sinkQueue[mqttUpdate]
+	// closeOnce makes Close safe to call again, e.g. on a sink replaced by a reload
+	closeOnce sync.Once
+
+	// discovered is what discovery was last published for, by device id; it's
+	// published again when the entities change, e.g. a DMPPT450 is attached, or on reconnect
+	mu         sync.Mutex
+	discovered map[string]string
+}
+
+type mqttUpdate struct {
+	device DeviceConfig
+	data   *SBMSData
+	tasks  []SystemTaskInfo
+}
+
+// NewMQTTSink connects to the broker in the background, retrying until it's reachable;
+// energy finds the energy totals of a device
+func NewMQTTSink(config MQTTSinkConfig, energy func(device DeviceConfig) *energyTracker) (*MQTTSink, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	s := &MQTTSink{config: config, energy: energy, discovered: map[string]string{}}
+	opts := mqtt.NewClientOptions().
+		AddBroker(config.Broker).
+		SetClientID(config.ClientID).
+		SetUsername(config.Username).
+		SetPassword(config.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(mqttConnectRetryInterval).
+		SetWill(s.statusTopic(), mqttOffline, config.QoS, true).
+		SetOnConnectHandler(s.onConnect).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			slog.Warn("lost connection to mqtt broker", "broker", config.Broker, "err", err)
+		})
+	s.client = mqtt.NewClient(opts)
+	s.client.Connect()
+	s.queue = newSinkQueue("mqtt", s.send)
+	return s, nil
+}
+
+func (s *MQTTSink) PublishRawData(device DeviceConfig, data *SBMSData) {
+	s.queue.push(mqttUpdate{device: device, data: data})
+}
+
+func (s *MQTTSink) PublishSystemTasks(device DeviceConfig, tasks []SystemTaskInfo) {
+	s.queue.push(mqttUpdate{device: device, tasks: tasks})
+}
+
+func (s *MQTTSink) Close() {
+	s.closeOnce.Do(func() {
+		s.queue.close()
+		s.publish(s.statusTopic(), true, []byte(mqttOffline))
+		s.client.Disconnect(250)
+	})
+}
+
+// onConnect marks the exporter online, and has discovery published again in case the broker lost it
+func (s *MQTTSink) onConnect(client mqtt.Client) {
+	slog.Info("connected to mqtt broker", "broker", s.config.Broker)
+	s.mu.Lock()
+	s.discovered = map[string]string{}
+	s.mu.Unlock()
+	token := client.Publish(s.statusTopic(), s.config.QoS, true, mqttOnline)
+	go func() {
+		if token.WaitTimeout(mqttPublishTimeout) && token.Error() != nil {
+			slog.Warn("could not publish to mqtt", "topic", s.statusTopic(), "err", token.Error())
+		}
+	}()
+}
+
+func (s *MQTTSink) send(update mqttUpdate) {
+	id := mqttDeviceID(update.device)
+	if update.data != nil {
+		if s.config.Discovery {
+			s.publishDiscovery(update.device, id, update.data)
+		}
+		b, err := json.Marshal(s.stateValues(update.device, update.data))
+		if err != nil {
+			slog.Warn("could not encode readings", "err", err)
+			return
+		}
+		s.publish(s.deviceTopic(id, "state"), s.config.Retain, b)
+	}
+	if update.tasks != nil {
+		b, err := json.Marshal(taskValues(update.tasks))
+		if err != nil {
+			slog.Warn("could not encode tasks", "err", err)
+			return
+		}
+		s.publish(s.deviceTopic(id, "tasks"), s.config.Retain, b)
+	}
+}
+
+// stateValues are the readings of data, with the energy totals of the device in place of
+// the registers, which go back on a reset while Home Assistant expects them to only increase
+func (s *MQTTSink) stateValues(device DeviceConfig, data *SBMSData) map[string]any {
+	values := fieldValues(data)
+	if s.energy == nil {
+		return values
+	}
+	if energy := s.energy(device); energy != nil {
+		totals := energy.totals()
+		for i, c := range energyCounters {
+			if _, ok := values["energy_"+c.name]; ok {
+				values["energy_"+c.name] = totals[i]
+			}
+		}
+	}
+	return values
+}
+
+// publish waits for the broker to take payload; while it's unreachable payload is dropped,
+// so that updates don't pile up
+func (s *MQTTSink) publish(topic string, retain bool, payload []byte) {
+	if !s.client.IsConnectionOpen() {
+		slog.Debug("not connected to mqtt broker, dropping update", "topic", topic)
+		return
+	}
+	token := s.client.Publish(topic, s.config.QoS, retain, payload)
+	if !token.WaitTimeout(mqttPublishTimeout) {
+		slog.Warn("timed out publishing to mqtt", "topic", topic)
+		return
+	}
+	if err := token.Error(); err != nil {
+		slog.Warn("could not publish to mqtt", "topic", topic, "err", err)
+	}
+}
+
+func (s *MQTTSink) statusTopic() string {
+	return s.config.TopicPrefix + "/status"
+}
+
+func (s *MQTTSink) deviceTopic(id, name string) string {
+	return s.config.TopicPrefix + "/" + id + "/" + name
+}
+
+// haEntity is the discovery config of one Home Assistant sensor or binary_sensor
+type haEntity struct {
+	Name              string   `json:"name"`
+	UniqueID          string   `json:"unique_id"`
+	StateTopic        string   `json:"state_topic"`
+	ValueTemplate     string   `json:"value_template"`
+	Unit              string   `json:"unit_of_measurement,omitempty"`
+	DeviceClass       string   `json:"device_class,omitempty"`
+	StateClass        string   `json:"state_class,omitempty"`
+	AvailabilityTopic string   `json:"availability_topic"`
+	Device            haDevice `json:"device"`
+}
+
+type haDevice struct {
+	Identifiers   []string `json:"identifiers"`
+	Name          string   `json:"name"`
+	Model         string   `json:"model,omitempty"`
+	Manufacturer  string   `json:"manufacturer"`
+	SuggestedArea string   `json:"suggested_area,omitempty"`
+}
+
+const (
+	haSensor       = "sensor"
+	haBinarySensor = "binary_sensor"
+)
+
+// publishDiscovery publishes a retained discovery config for every reading of data,
+// unless the same entities were already published for the device
+func (s *MQTTSink) publishDiscovery(device DeviceConfig, id string, data *SBMSData) {
+	entities := haEntities(device, id, data, s.deviceTopic(id, "state"), s.statusTopic())
+	signature := fmt.Sprintf("%s/%d", data.model, len(entities))
+	s.mu.Lock()
+	published := s.discovered[id] == signature
+	s.discovered[id] = signature
+	s.mu.Unlock()
+	if published {
+		return
+	}
+
+	for _, e := range entities {
+		b, err := json.Marshal(e.entity)
+		if err != nil {
+			slog.Warn("could not encode discovery", "err", err)
+			continue
+		}
+		s.publish(fmt.Sprintf("%s/%s/sbms_%s/%s/config", s.config.DiscoveryPrefix, e.component, id, e.field), true, b)
+	}
+}
+
+type haDiscovered struct {
+	component string
+	field     string
+	entity    haEntity
+}
+
+// haEntities are the entities of the readings fieldValues has for data
+func haEntities(device DeviceConfig, id string, data *SBMSData, stateTopic, availabilityTopic string) []haDiscovered {
+	name := device.Name
+	if name == "" {
+		name = data.model
+	}
+	d := haDevice{
+		Identifiers:   []string{"sbms_" + id},
+		Name:          name,
+		Model:         data.model,
+		Manufacturer:  "Electrodacus",
+		SuggestedArea: device.Site,
+	}
+	entity := func(component, field string) haEntity {
+		template := "{{ value_json." + field + " }}"
+		if component == haBinarySensor {
+			template = "{{ 'ON' if value_json." + field + " else 'OFF' }}"
+		}
+		return haEntity{
+			Name:              fieldTitle(field),
+			UniqueID:          "sbms_" + id + "_" + field,
+			StateTopic:        stateTopic,
+			ValueTemplate:     template,
+			AvailabilityTopic: availabilityTopic,
+			Device:            d,
+		}
+	}
+
+	var entities []haDiscovered
+	for _, f := range dataFields {
+		if f.has != nil && !f.has(data) {
+			continue
+		}
+		e := entity(haSensor, f.name)
+		e.Unit, e.DeviceClass, e.StateClass = f.unit, f.deviceClass, f.stateClass
+		entities = append(entities, haDiscovered{component: haSensor, field: f.name, entity: e})
+	}
+	for i := range data.cells {
+		field := cellFieldName(i)
+		e := entity(haSensor, field)
+		e.Unit, e.DeviceClass, e.StateClass = "mV", "voltage", stateClassMeasurement
+		entities = append(entities, haDiscovered{component: haSensor, field: field, entity: e})
+		entities = append(entities, haDiscovered{component: haBinarySensor, field: field + "_balancing", entity: entity(haBinarySensor, field+"_balancing")})
+	}
+	for _, f := range flagFields {
+		field := "flag_" + f.name
+		e := entity(haBinarySensor, field)
+		e.Name = f.help
+		if f.problem {
+			e.DeviceClass = "problem"
+		}
+		entities = append(entities, haDiscovered{component: haBinarySensor, field: field, entity: e})
+	}
+	return entities
+}
+
+var mqttInvalidID = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// mqttDeviceID is the device in topics and unique ids, e.g. 192_168_1_10 for an unnamed device
+func mqttDeviceID(device DeviceConfig) string {
+	return mqttInvalidID.ReplaceAllString(device.id(), "_")
+}
+
+// taskValues are the tasks of the debug endpoint by name
+func taskValues(tasks []SystemTaskInfo) map[string]any {
+	values := make(map[string]any, len(tasks))
+	for _, t := range tasks {
+		values[t.name] = map[string]float64{
+			"state":            t.state,
+			"priority":         t.priority,
+			"run_time":         t.runTimeCounter,
+			"run_time_percent": t.runTimePercent,
+		}
+	}
+	return values
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testBroker is an embedded broker that records what is published to it
+type testBroker struct {
+	url string
+
+	mu       sync.Mutex
+	messages map[string][]byte
+}
+
+func startTestBroker(t *testing.T) *testBroker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+
+	server := mochi.New(&mochi.Options{InlineClient: true})
+	assert.Nil(t, server.AddHook(new(auth.AllowHook), nil))
+	assert.Nil(t, server.AddListener(listeners.NewTCP("test", addr, nil)))
+	assert.Nil(t, server.Serve())
+	t.Cleanup(func() { _ = server.Close() })
+
+	b := &testBroker{url: "tcp://" + addr, messages: map[string][]byte{}}
+	assert.Nil(t, server.Subscribe("#", 1, func(_ *mochi.Client, _ packets.Subscription, pk packets.Packet) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.messages[pk.TopicName] = pk.Payload
+	}))
+	return b
+}
+
+// message waits for a message on topic
+func (b *testBroker) message(t *testing.T, topic string) []byte {
+	var payload []byte
+	assert.Eventually(t, func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		var ok bool
+		payload, ok = b.messages[topic]
+		return ok
+	}, 5*time.Second, 10*time.Millisecond, topic)
+	return payload
+}
+
+func testMQTTSink(t *testing.T, broker string) *MQTTSink {
+	config := defaultMQTTSinkConfig()
+	config.Enabled = true
+	config.Broker = broker
+	sink, err := NewMQTTSink(config, nil)
+	assert.Nil(t, err)
+	return sink
+}
+
+func TestMQTTSinkPublishes(t *testing.T) {
+	broker := startTestBroker(t)
+	sink := testMQTTSink(t, broker.url)
+	assert.Eventually(t, sink.client.IsConnectionOpen, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, mqttOnline, string(broker.message(t, "sbms/status")))
+
+	data, err := Decode(readFileContent(t, "./__source__/rawData6"))
+	assert.Nil(t, err)
+	shed := DeviceConfig{Name: "shed", URL: "192.168.1.10", Site: "home"}
+	sink.PublishRawData(shed, data)
+	sink.PublishSystemTasks(shed, decodeDebugResponse(readFileContent(t, "./__source__/debug1")))
+
+	var state map[string]any
+	assert.Nil(t, json.Unmarshal(broker.message(t, "sbms/shed/state"), &state))
+	assert.Equal(t, 69.0, state["soc"])
+	assert.Equal(t, 3310.0, state["cell_1"])
+	assert.Equal(t, false, state["cell_1_balancing"])
+	assert.Equal(t, true, state["flag_cfet"])
+	assert.Equal(t, 398056.7, state["energy_battery_wh"])
+	assert.Equal(t, "2024-02-20T13:32:56", state["ts"])
+
+	var tasks map[string]map[string]float64
+	assert.Nil(t, json.Unmarshal(broker.message(t, "sbms/shed/tasks"), &tasks))
+	assert.NotEmpty(t, tasks)
+
+	var soc haEntity
+	assert.Nil(t, json.Unmarshal(broker.message(t, "homeassistant/sensor/sbms_shed/soc/config"), &soc))
+	assert.Equal(t, "%", soc.Unit)
+	assert.Equal(t, "battery", soc.DeviceClass)
+	assert.Equal(t, "sbms/shed/state", soc.StateTopic)
+	assert.Equal(t, "{{ value_json.soc }}", soc.ValueTemplate)
+	assert.Equal(t, "sbms_shed_soc", soc.UniqueID)
+	assert.Equal(t, haDevice{Identifiers: []string{"sbms_shed"}, Name: "shed", Model: "SBMS0", Manufacturer: "Electrodacus", SuggestedArea: "home"}, soc.Device)
+
+	var energy haEntity
+	assert.Nil(t, json.Unmarshal(broker.message(t, "homeassistant/sensor/sbms_shed/energy_pv1_wh/config"), &energy))
+	assert.Equal(t, "Wh", energy.Unit)
+	assert.Equal(t, "energy", energy.DeviceClass)
+	assert.Equal(t, stateClassTotalIncreasing, energy.StateClass)
+
+	var ov haEntity
+	assert.Nil(t, json.Unmarshal(broker.message(t, "homeassistant/binary_sensor/sbms_shed/flag_ov/config"), &ov))
+	assert.Equal(t, "problem", ov.DeviceClass)
+	assert.Equal(t, "Over Voltage", ov.Name)
+	broker.message(t, "homeassistant/sensor/sbms_shed/cell_8/config")
+
+	sink.Close()
+	assert.Equal(t, mqttOffline, string(broker.message(t, "sbms/status")))
+}
+
+func TestMQTTSinkBrokerDown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := l.Addr().String()
+	_ = l.Close()
+
+	sink := testMQTTSink(t, "tcp://"+addr)
+	data, err := Decode(readFileContent(t, "./__source__/rawData6"))
+	assert.Nil(t, err)
+	for i := 0; i < sinkQueueSize*2; i++ {
+		sink.PublishRawData(DeviceConfig{URL: "192.168.1.10"}, data)
+	}
+
+	// neither polling nor closing waits for the broker
+	start := time.Now()
+	sink.Close()
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestMQTTDeviceID(t *testing.T) {
+	assert.Equal(t, "shed", mqttDeviceID(DeviceConfig{Name: "shed", URL: "192.168.1.10"}))
+	assert.Equal(t, "192_168_1_10", mqttDeviceID(DeviceConfig{URL: "http://192.168.1.10/rawData"}))
+	assert.Equal(t, "192_168_1_10_8080", mqttDeviceID(DeviceConfig{URL: "192.168.1.10:8080"}))
+}
+
+func TestExporterPublishesToMQTT(t *testing.T) {
+	broker := startTestBroker(t)
+	device := serveContent(readFileContent(t, "./__source__/rawData6"), http.StatusOK)
+	defer device.Close()
+
+	// the energy totals carry on from the state, rather than from the registers
+	path := filepath.Join(t.TempDir(), "state.json")
+	state := &energyState{Devices: map[string]map[string]energyRegisterState{
+		"shed": {"battery_wh": {Last: 398000, Offset: 1000}},
+	}}
+	assert.Nil(t, state.save(path))
+
+	config := configWithDevices(DeviceConfig{Name: "shed", URL: device.URL})
+	config.State.Path = path
+	config.Collectors = []string{collectorRawData}
+	// polls from before the sink connected are dropped
+	config.PollInterval = 50 * time.Millisecond
+	config.Sinks.MQTT.Enabled = true
+	config.Sinks.MQTT.Broker = broker.url
+	var loadErr error
+	testExporter(t, &config, &loadErr)
+
+	var readings map[string]any
+	assert.Nil(t, json.Unmarshal(broker.message(t, "sbms/shed/state"), &readings))
+	assert.Equal(t, 69.0, readings["soc"])
+	assert.Equal(t, 399056.7, readings["energy_battery_wh"])
+}
+
+func TestExporterReloadKeepsMQTTSink(t *testing.T) {
+	broker := startTestBroker(t)
+	config := configWithDevices()
+	config.Sinks.MQTT.Enabled = true
+	config.Sinks.MQTT.Broker = broker.url
+	var loadErr error
+	exporter := testExporter(t, &config, &loadErr)
+	sink := exporter.current.Load().sinks["mqtt"].sink.(*MQTTSink)
+	assert.Eventually(t, sink.client.IsConnectionOpen, 5*time.Second, 10*time.Millisecond)
+
+	// an unchanged sink stays connected
+	assert.Nil(t, exporter.Reload())
+	assert.Same(t, sink, exporter.current.Load().sinks["mqtt"].sink)
+	assert.True(t, sink.client.IsConnected())
+	assert.Equal(t, mqttOnline, string(broker.message(t, "sbms/status")))
+
+	// a changed one is replaced, and the old one is gone before the new one connects
+	changed := *config
+	changed.Sinks.MQTT.Retain = true
+	config = &changed
+	assert.Nil(t, exporter.Reload())
+	replaced := exporter.current.Load().sinks["mqtt"].sink.(*MQTTSink)
+	assert.NotSame(t, sink, replaced)
+	assert.False(t, sink.client.IsConnected())
+	assert.Eventually(t, replaced.client.IsConnectionOpen, 5*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return string(broker.message(t, "sbms/status")) == mqttOnline
+	}, 5*time.Second, 10*time.Millisecond)
+	// it stays online, rather than being knocked off by the old client
+	time.Sleep(100 * time.Millisecond)
+	assert.True(t, replaced.client.IsConnectionOpen())
+	assert.Equal(t, mqttOnline, string(broker.message(t, "sbms/status")))
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	otlpProtocolGRPC        = "grpc"
+	otlpProtocolHTTP        = "http"
+	defaultOTLPEndpoint     = "localhost:4317"
+	defaultOTLPInterval     = 30 * time.Second
+	defaultOTLPTimeout      = 10 * time.Second
+	defaultOTLPServiceName  = "sbms_exporter"
+	otlpResourceAttrPrefix  = "sbms."
+	otlpManufacturer        = "Electrodacus"
+	otlpInstrumentationName = "sbms_exporter"
+	// otlpStalePolls is how many poll intervals a poll is exported for, so a device
+	// that went offline stops exporting its last readings
+	otlpStalePolls = 3
+)
+
+// OTLPSinkConfig exports the metrics of every device to an OpenTelemetry collector
+type OTLPSinkConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Protocol is grpc or http
+	Protocol string `yaml:"protocol"`
+	// Endpoint is the host:port of the collector, e.g. localhost:4317 for grpc or localhost:4318 for http
+	Endpoint string            `yaml:"endpoint"`
+	Insecure bool              `yaml:"insecure"`
+	Headers  map[string]string `yaml:"headers"`
+	// Interval is how often the metrics are exported
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+func defaultOTLPSinkConfig() OTLPSinkConfig {
+	return OTLPSinkConfig{
+		Protocol: otlpProtocolGRPC,
+		Endpoint: defaultOTLPEndpoint,
+		Interval: defaultOTLPInterval,
+		Timeout:  defaultOTLPTimeout,
+	}
+}
+
+func (c OTLPSinkConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.Protocol != otlpProtocolGRPC && c.Protocol != otlpProtocolHTTP {
+		return fmt.Errorf("otlp protocol must be %s or %s, not %s", otlpProtocolGRPC, otlpProtocolHTTP, c.Protocol)
+	}
+	if c.Endpoint == "" {
+		return errors.New("otlp endpoint is empty")
+	}
+	if c.Interval <= 0 {
+		return fmt.Errorf("otlp interval must be positive, not %s", c.Interval)
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("otlp timeout must be positive, not %s", c.Timeout)
+	}
+	return nil
+}
+
+// OTLPSink exports the metrics of the Prometheus endpoints with OTLP, under the same names.
+// The readings are Gauges and the energy totals are Sums. Each device has its own resource,
+// carrying its name, model, url and site, so each gets a MeterProvider once its model is known.
+// The readings of a poll older than otlpStalePolls poll intervals are no longer exported, while
+// sbms_up and sbms_snapshot_age_seconds tell that the device went offline.
+type OTLPSink struct {
+	config       OTLPSinkConfig
+	prefix       string
+	pollInterval time.Duration
+	// energy finds the energy totals of a device, which are kept by the exporter
+	energy func(device DeviceConfig) *energyTracker
+	// results finds the rawData poller of a device, for the health of its scrapes
+	results func(device DeviceConfig) (PollResult[*SBMSData], bool)
+
+	mu      sync.Mutex
+	devices map[string]*otlpDevice
+	closed  bool
+}
+
+// otlpDevice is the latest poll of a device, which the instruments observe on every export
+type otlpDevice struct {
+	device   DeviceConfig
+	model    string
+	provider *sdkmetric.MeterProvider
+
+	mu      sync.Mutex
+	data    *SBMSData
+	dataAt  time.Time
+	tasks   []SystemTaskInfo
+	tasksAt time.Time
+}
+
+func NewOTLPSink(config OTLPSinkConfig, prefix string, pollInterval time.Duration, energy func(device DeviceConfig) *energyTracker, results func(device DeviceConfig) (PollResult[*SBMSData], bool)) (*OTLPSink, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return &OTLPSink{config: config, prefix: prefix, pollInterval: pollInterval, energy: energy, results: results, devices: map[string]*otlpDevice{}}, nil
+}
+
+func (s *OTLPSink) PublishRawData(device DeviceConfig, data *SBMSData) {
+	if d := s.deviceFor(device, data.model); d != nil {
+		d.mu.Lock()
+		d.data, d.dataAt = data, time.Now()
+		d.mu.Unlock()
+	}
+}
+
+func (s *OTLPSink) PublishSystemTasks(device DeviceConfig, tasks []SystemTaskInfo) {
+	if d := s.deviceFor(device, ""); d != nil {
+		d.mu.Lock()
+		d.tasks, d.tasksAt = tasks, time.Now()
+		d.mu.Unlock()
+	}
+}
+
+// stale tells whether a poll made at polledAt is too old to be exported
+func (s *OTLPSink) stale(polledAt time.Time) bool {
+	return time.Since(polledAt) > otlpStalePolls*s.pollInterval
+}
+
+// Close exports the latest polls once more
+func (s *OTLPSink) Close() {
+	s.mu.Lock()
+	s.closed = true
+	devices := s.devices
+	s.devices = map[string]*otlpDevice{}
+	s.mu.Unlock()
+	for _, d := range devices {
+		s.shutdown(d)
+	}
+}
+
+// deviceFor returns the device, creating its MeterProvider on the first poll. A model
+// that differs from the resource, e.g. the first rawData after a debug poll, replaces it.
+func (s *OTLPSink) deviceFor(device DeviceConfig, model string) *otlpDevice {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	key := device.energyKey()
+	d, ok := s.devices[key]
+	if ok && (model == "" || model == d.model) {
+		return d
+	}
+
+	next := &otlpDevice{device: device, model: model}
+	if ok {
+		d.mu.Lock()
+		next.data, next.dataAt, next.tasks, next.tasksAt = d.data, d.dataAt, d.tasks, d.tasksAt
+		d.mu.Unlock()
+		go s.shutdown(d)
+	}
+	provider, err := s.newMeterProvider(next)
+	if err != nil {
+		slog.Warn("could not create otlp exporter", "err", err)
+		return nil
+	}
+	next.provider = provider
+	s.devices[key] = next
+	return next
+}
+
+func (s *OTLPSink) shutdown(d *otlpDevice) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.Timeout)
+	defer cancel()
+	if err := d.provider.Shutdown(ctx); err != nil {
+		slog.Warn("could not export to otlp", "err", err)
+	}
+}
+
+func (s *OTLPSink) newExporter() (sdkmetric.Exporter, error) {
+	ctx := context.Background()
+	if s.config.Protocol == otlpProtocolHTTP {
+		opts := []otlpmetrichttp.Option{otlpmetrichttp.WithEndpoint(s.config.Endpoint), otlpmetrichttp.WithTimeout(s.config.Timeout)}
+		if s.config.Insecure {
+			opts = append(opts, otlpmetrichttp.WithInsecure())
+		}
+		if len(s.config.Headers) > 0 {
+			opts = append(opts, otlpmetrichttp.WithHeaders(s.config.Headers))
+		}
+		return otlpmetrichttp.New(ctx, opts...)
+	}
+	opts := []otlpmetricgrpc.Option{otlpmetricgrpc.WithEndpoint(s.config.Endpoint), otlpmetricgrpc.WithTimeout(s.config.Timeout)}
+	if s.config.Insecure {
+		opts = append(opts, otlpmetricgrpc.WithInsecure())
+	}
+	if len(s.config.Headers) > 0 {
+		opts = append(opts, otlpmetricgrpc.WithHeaders(s.config.Headers))
+	}
+	return otlpmetricgrpc.New(ctx, opts...)
+}
+
+// otlpResource describes the device, leaving out what isn't known or configured
+func otlpResource(device DeviceConfig, model string) *resource.Resource {
+	attrs := []attribute.KeyValue{
+		attribute.String("service.name", defaultOTLPServiceName),
+		attribute.String(otlpResourceAttrPrefix+"manufacturer", otlpManufacturer),
+		attribute.String(otlpResourceAttrPrefix+"url", device.URL),
+	}
+	for key, value := range map[string]string{
+		"device":       device.Name,
+		"model":        model,
+		"site":         device.Site,
+		"battery_bank": device.BatteryBank,
+	} {
+		if value != "" {
+			attrs = append(attrs, attribute.String(otlpResourceAttrPrefix+key, value))
+		}
+	}
+	return resource.NewSchemaless(attrs...)
+}
+
+func (s *OTLPSink) newMeterProvider(d *otlpDevice) (*sdkmetric.MeterProvider, error) {
+	exporter, err := s.newExporter()
+	if err != nil {
+		return nil, err
+	}
+	provider := sdkmetric.NewMeterProvider(
+		sdkmetric.WithResource(otlpResource(d.device, d.model)),
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter, sdkmetric.WithInterval(s.config.Interval), sdkmetric.WithTimeout(s.config.Timeout))),
+	)
+	if err := s.registerInstruments(provider.Meter(otlpInstrumentationName), d); err != nil {
+		_ = provider.Shutdown(context.Background())
+		return nil, err
+	}
+	return provider, nil
+}
+
+// registerInstruments creates an instrument for every metric the collectors export
+// for the device, which observes its latest poll
+func (s *OTLPSink) registerInstruments(meter metric.Meter, d *otlpDevice) error {
+	var instruments []metric.Observable
+	newGauge := func(name, help, unit string) (metric.Float64ObservableGauge, error) {
+		gauge, err := meter.Float64ObservableGauge(name, metric.WithDescription(help), metric.WithUnit(unit))
+		instruments = append(instruments, gauge)
+		return gauge, err
+	}
+
+	var errs []error
+	gauges := make([]metric.Float64ObservableGauge, len(rawDataGauges))
+	for i, g := range rawDataGauges {
+		var err error
+		gauges[i], err = newGauge(prometheus.BuildFQName(s.prefix, g.subsystem, g.name), g.help, "")
+		errs = append(errs, err)
+	}
+	counters := make([]metric.Float64ObservableCounter, len(energyCounters))
+	for i, c := range energyCounters {
+		var err error
+		counters[i], err = meter.Float64ObservableCounter(prometheus.BuildFQName(s.prefix, "energy", c.name), metric.WithDescription(c.help), metric.WithUnit(otlpEnergyUnit(c.name)))
+		instruments = append(instruments, counters[i])
+		errs = append(errs, err)
+	}
+	cellVoltage, err := newGauge(s.prefix+"_cell_voltage", "Cell Voltage", "mV")
+	errs = append(errs, err)
+	cellBalancing, err := newGauge(s.prefix+"_cell_balancing", "Cell Balancing", "")
+	errs = append(errs, err)
+	averageCurrent, err := newGauge(s.prefix+"_average_current", "Average Current calculated by the SBMS0, in A", "A")
+	errs = append(errs, err)
+	averagePower, err := newGauge(s.prefix+"_average_power", "Average Power calculated by the SBMS0, in W", "W")
+	errs = append(errs, err)
+	dmpptChannelCurrent, err := newGauge(s.prefix+"_dmppt_channel_current", "DMPPT PV Output Current", "")
+	errs = append(errs, err)
+	info, err := newGauge(s.prefix+"_info", "Model and units configured on the SBMS0", "")
+	errs = append(errs, err)
+	up, err := newGauge(s.prefix+"_up", "Whether the last scrape of the SBMS0 succeeded", "")
+	errs = append(errs, err)
+	scrapeDuration, err := newGauge(s.prefix+"_scrape_duration_seconds", "How long the last scrape of the SBMS0 took", "s")
+	errs = append(errs, err)
+	snapshotAge, err := newGauge(s.prefix+"_snapshot_age_seconds", "Time since the SBMS0 was last scraped successfully", "s")
+	errs = append(errs, err)
+	scrapeErrors, err := meter.Float64ObservableCounter(s.prefix+"_scrape_errors", metric.WithDescription("Number of failed scrapes of the SBMS0, by the stage that failed"))
+	instruments = append(instruments, scrapeErrors)
+	errs = append(errs, err)
+	tasks := make([]metric.Float64ObservableGauge, len(systemTaskGauges))
+	for i, g := range systemTaskGauges {
+		tasks[i], err = newGauge(prometheus.BuildFQName(s.prefix, "system", g.name), "", "")
+		errs = append(errs, err)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	_, err = meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		d.mu.Lock()
+		data, dataAt, systemTasks, tasksAt := d.data, d.dataAt, d.tasks, d.tasksAt
+		d.mu.Unlock()
+
+		// like exportPollResult; the counter goes without _total, which OTel adds back for Prometheus
+		if result, ok := s.results(d.device); ok {
+			o.ObserveFloat64(up, boolToFloat(result.LastErr == nil && result.HasLatest))
+			o.ObserveFloat64(scrapeDuration, result.LastDuration.Seconds())
+			if result.HasLatest {
+				o.ObserveFloat64(snapshotAge, time.Since(result.LastSuccess).Seconds())
+			}
+			for _, stage := range scrapeStages {
+				o.ObserveFloat64(scrapeErrors, float64(result.Errors[stage]), metric.WithAttributes(attribute.String("stage", stage)))
+			}
+		}
+
+		if data != nil && !s.stale(dataAt) {
+			o.ObserveFloat64(info, 1, metric.WithAttributes(
+				attribute.String("model", data.model),
+				attribute.String("capacity_unit", data.capacityUnit),
+				attribute.String("graph_unit", data.graphUnit),
+			))
+			for i, g := range rawDataGauges {
+				if g.has == nil || g.has(data) {
+					o.ObserveFloat64(gauges[i], g.value(data))
+				}
+			}
+			// data was already observed, before it was published; the tracker is looked
+			// up on every export, as the sink outlives reloads
+			if energy := s.energy(d.device); energy != nil {
+				totals := energy.totals()
+				for i, c := range energyCounters {
+					if c.has == nil || c.has(data) {
+						o.ObserveFloat64(counters[i], totals[i])
+					}
+				}
+			}
+			for i, cell := range data.cells {
+				attrs := metric.WithAttributes(attribute.String("cell", strconv.Itoa(i+1)))
+				o.ObserveFloat64(cellVoltage, float64(cell.mV), attrs)
+				o.ObserveFloat64(cellBalancing, boolToFloat(cell.isBalancing), attrs)
+			}
+			for _, a := range data.averages {
+				gauge := averageCurrent
+				if data.graphUnit == graphUnitWatts {
+					gauge = averagePower
+				}
+				o.ObserveFloat64(gauge, a.value, metric.WithAttributes(attribute.String("source", a.source), attribute.String("window", a.window)))
+			}
+			if data.dmppt != nil {
+				for i, current := range data.dmppt.channelCurrents {
+					o.ObserveFloat64(dmpptChannelCurrent, current, metric.WithAttributes(attribute.String("channel", strconv.Itoa(i+1))))
+				}
+			}
+		}
+		if s.stale(tasksAt) {
+			systemTasks = nil
+		}
+		for _, t := range systemTasks {
+			for i, g := range systemTaskGauges {
+				o.ObserveFloat64(tasks[i], g.value(t), metric.WithAttributes(attribute.String("task", t.name)))
+			}
+		}
+		return nil
+	}, instruments...)
+	return err
+}
+
+// otlpEnergyUnit is the unit of an energy register, from the suffix of its name
+func otlpEnergyUnit(name string) string {
+	if strings.HasSuffix(name, "_ah") {
+		return "A.h"
+	}
+	return "W.h"
+}
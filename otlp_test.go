@@ -0,0 +1,225 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	collectormetrics "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// otlpServer records the metrics exported to it over OTLP/HTTP
+type otlpServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []*collectormetrics.ExportMetricsServiceRequest
+}
+
+func newOTLPServer(t *testing.T) *otlpServer {
+	s := &otlpServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/metrics", r.URL.Path)
+		body, _ := io.ReadAll(r.Body)
+		request := &collectormetrics.ExportMetricsServiceRequest{}
+		if !assert.Nil(t, proto.Unmarshal(body, request)) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		s.requests = append(s.requests, request)
+		s.mu.Unlock()
+		b, _ := proto.Marshal(&collectormetrics.ExportMetricsServiceResponse{})
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		_, _ = w.Write(b)
+	}))
+	return s
+}
+
+// resourceMetrics are the metrics exported so far
+func (s *otlpServer) resourceMetrics() []*metricspb.ResourceMetrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var metrics []*metricspb.ResourceMetrics
+	for _, r := range s.requests {
+		metrics = append(metrics, r.ResourceMetrics...)
+	}
+	return metrics
+}
+
+func otlpMetric(rm *metricspb.ResourceMetrics, name string) *metricspb.Metric {
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name == name {
+				return m
+			}
+		}
+	}
+	return nil
+}
+
+func TestOTLPSinkExports(t *testing.T) {
+	server := newOTLPServer(t)
+	defer server.Close()
+
+	data, err := Decode(readFileContent(t, "./__source__/rawData6"))
+	assert.Nil(t, err)
+	device := DeviceConfig{Name: "shed", URL: "http://192.168.1.10", Site: "home"}
+	energy := newEnergyTracker()
+	energy.observe(data)
+
+	config := defaultOTLPSinkConfig()
+	config.Enabled = true
+	config.Protocol = otlpProtocolHTTP
+	config.Endpoint = strings.TrimPrefix(server.URL, "http://")
+	config.Insecure = true
+	config.Headers = map[string]string{"Authorization": "Bearer secret"}
+	config.Interval = time.Hour
+	results := func(DeviceConfig) (PollResult[*SBMSData], bool) {
+		return PollResult[*SBMSData]{Latest: data, HasLatest: true, LastSuccess: time.Now(), Errors: map[string]uint64{stageHTTP: 2}}, true
+	}
+	sink, err := NewOTLPSink(config, "sbms", time.Minute, func(DeviceConfig) *energyTracker { return energy }, results)
+	assert.Nil(t, err)
+	sink.PublishRawData(device, data)
+	sink.PublishSystemTasks(device, []SystemTaskInfo{{name: "loop", state: 2}})
+
+	// the latest poll is exported on close
+	sink.Close()
+	metrics := server.resourceMetrics()
+	if !assert.Len(t, metrics, 1) {
+		return
+	}
+	rm := metrics[0]
+
+	attrs := map[string]string{}
+	for _, kv := range rm.Resource.Attributes {
+		attrs[kv.Key] = kv.Value.GetStringValue()
+	}
+	assert.Equal(t, "sbms_exporter", attrs["service.name"])
+	assert.Equal(t, "shed", attrs["sbms.device"])
+	assert.Equal(t, "SBMS0", attrs["sbms.model"])
+	assert.Equal(t, "http://192.168.1.10", attrs["sbms.url"])
+	assert.Equal(t, "home", attrs["sbms.site"])
+	assert.NotContains(t, attrs, "sbms.battery_bank")
+
+	up := otlpMetric(rm, "sbms_up")
+	if assert.NotNil(t, up) && assert.NotNil(t, up.GetGauge()) {
+		assert.Equal(t, 1.0, up.GetGauge().DataPoints[0].GetAsDouble())
+	}
+	assert.NotNil(t, otlpMetric(rm, "sbms_snapshot_age_seconds"))
+	scrapeErrors := otlpMetric(rm, "sbms_scrape_errors")
+	if assert.NotNil(t, scrapeErrors) && assert.NotNil(t, scrapeErrors.GetSum()) {
+		assert.Len(t, scrapeErrors.GetSum().DataPoints, len(scrapeStages))
+	}
+	info := otlpMetric(rm, "sbms_info")
+	if assert.NotNil(t, info) && assert.NotNil(t, info.GetGauge()) {
+		infoAttrs := map[string]string{}
+		for _, kv := range info.GetGauge().DataPoints[0].Attributes {
+			infoAttrs[kv.Key] = kv.Value.GetStringValue()
+		}
+		assert.Equal(t, "SBMS0", infoAttrs["model"])
+		assert.Contains(t, infoAttrs, "capacity_unit")
+		assert.Contains(t, infoAttrs, "graph_unit")
+	}
+
+	soc := otlpMetric(rm, "sbms_battery_soc")
+	if assert.NotNil(t, soc) && assert.NotNil(t, soc.GetGauge()) {
+		assert.Equal(t, 69.0, soc.GetGauge().DataPoints[0].GetAsDouble())
+	}
+
+	pv1 := otlpMetric(rm, "sbms_energy_pv1_wh")
+	if assert.NotNil(t, pv1) && assert.NotNil(t, pv1.GetSum()) {
+		sum := pv1.GetSum()
+		assert.True(t, sum.IsMonotonic)
+		assert.Equal(t, metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE, sum.AggregationTemporality)
+		assert.Equal(t, 725043.8, sum.DataPoints[0].GetAsDouble())
+		assert.Equal(t, "W.h", pv1.Unit)
+	}
+
+	// without a DMPPT450 attached there are no DMPPT readings, like on the Prometheus endpoints
+	assert.Nil(t, otlpMetric(rm, "sbms_dmppt_version"))
+	assert.NotNil(t, otlpMetric(rm, "sbms_system_task_state"))
+
+	// nothing is exported after close
+	sink.PublishRawData(device, data)
+	assert.Len(t, server.resourceMetrics(), 1)
+}
+
+func TestOTLPSinkStopsExportingStalePolls(t *testing.T) {
+	server := newOTLPServer(t)
+	defer server.Close()
+
+	shedData, err := Decode(readFileContent(t, "./__source__/rawData6"))
+	assert.Nil(t, err)
+	garageData, err := Decode(readFileContent(t, "./__source__/rawData12"))
+	assert.Nil(t, err)
+	shed := DeviceConfig{Name: "shed", URL: "http://192.168.1.10"}
+	garage := DeviceConfig{Name: "garage", URL: "http://192.168.1.11"}
+
+	config := defaultOTLPSinkConfig()
+	config.Enabled = true
+	config.Protocol = otlpProtocolHTTP
+	config.Endpoint = strings.TrimPrefix(server.URL, "http://")
+	config.Insecure = true
+	config.Interval = time.Hour
+	pollInterval := 20 * time.Millisecond
+	polledAt := time.Now()
+	results := func(device DeviceConfig) (PollResult[*SBMSData], bool) {
+		if device.Name == "shed" {
+			// shed went offline after its first poll
+			return PollResult[*SBMSData]{Latest: shedData, HasLatest: true, LastSuccess: polledAt, LastErr: &ScrapeError{Stage: stageHTTP, Err: io.EOF}, Errors: map[string]uint64{stageHTTP: 5}}, true
+		}
+		return PollResult[*SBMSData]{Latest: garageData, HasLatest: true, LastSuccess: time.Now(), Errors: map[string]uint64{}}, true
+	}
+	sink, err := NewOTLPSink(config, "sbms", pollInterval, func(DeviceConfig) *energyTracker { return nil }, results)
+	assert.Nil(t, err)
+	sink.PublishRawData(shed, shedData)
+	sink.PublishSystemTasks(shed, []SystemTaskInfo{{name: "loop", state: 2}})
+	time.Sleep(otlpStalePolls*pollInterval + 10*time.Millisecond)
+	sink.PublishRawData(garage, garageData)
+
+	sink.Close()
+	devices := map[string]*metricspb.ResourceMetrics{}
+	for _, rm := range server.resourceMetrics() {
+		for _, kv := range rm.Resource.Attributes {
+			if kv.Key == "sbms.device" {
+				devices[kv.Value.GetStringValue()] = rm
+			}
+		}
+	}
+	if !assert.Len(t, devices, 2) {
+		return
+	}
+
+	// the readings of shed are stale, only its health is exported
+	rm := devices["shed"]
+	up := otlpMetric(rm, "sbms_up")
+	if assert.NotNil(t, up) && assert.NotNil(t, up.GetGauge()) {
+		assert.Equal(t, 0.0, up.GetGauge().DataPoints[0].GetAsDouble())
+	}
+	age := otlpMetric(rm, "sbms_snapshot_age_seconds")
+	if assert.NotNil(t, age) && assert.NotNil(t, age.GetGauge()) {
+		assert.Greater(t, age.GetGauge().DataPoints[0].GetAsDouble(), (otlpStalePolls * pollInterval).Seconds())
+	}
+	assert.NotNil(t, otlpMetric(rm, "sbms_scrape_errors"))
+	assert.Nil(t, otlpMetric(rm, "sbms_battery_soc"))
+	assert.Nil(t, otlpMetric(rm, "sbms_info"))
+	assert.Nil(t, otlpMetric(rm, "sbms_cell_voltage"))
+	assert.Nil(t, otlpMetric(rm, "sbms_system_task_state"))
+
+	// garage was polled just now, with a DMPPT450 attached
+	rm = devices["garage"]
+	up = otlpMetric(rm, "sbms_up")
+	if assert.NotNil(t, up) && assert.NotNil(t, up.GetGauge()) {
+		assert.Equal(t, 1.0, up.GetGauge().DataPoints[0].GetAsDouble())
+	}
+	assert.NotNil(t, otlpMetric(rm, "sbms_battery_soc"))
+	assert.NotNil(t, otlpMetric(rm, "sbms_info"))
+	assert.NotNil(t, otlpMetric(rm, "sbms_dmppt_version"))
+}
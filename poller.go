@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const defaultPollInterval = 10 * time.Second
+
+// Poller fetches an endpoint of the SBMS0 on an interval and keeps the latest decoded response,
+// so scrapes are served from memory rather than each making a request to the ESP32
+type Poller[T any] struct {
+	url      string
+	interval time.Duration
+	client   *DeviceClient
+	logger   *slog.Logger
+	decode   func([]byte) (T, error)
+	// onSuccess, if set, is handed every successfully decoded response
+	onSuccess func(T)
+
+	mu           sync.RWMutex
+	latest       T
+	hasLatest    bool
+	lastSuccess  time.Time
+	lastErr      error
+	lastDuration time.Duration
+	requests     uint64
+	respBytes    uint64
+	errors       map[string]uint64
+}
+
+// PollResult is the state of a Poller at one point in time
+type PollResult[T any] struct {
+	Latest       T
+	HasLatest    bool
+	LastSuccess  time.Time
+	LastErr      error
+	LastDuration time.Duration
+	Requests     uint64
+	RespBytes    uint64
+	Errors       map[string]uint64
+	CircuitState int
+}
+
+func NewPoller[T any](url string, interval time.Duration, client *DeviceClient, logger *slog.Logger, decode func([]byte) (T, error)) *Poller[T] {
+	return &Poller[T]{url: url, interval: interval, client: client, logger: logger.With("url", url), decode: decode, errors: map[string]uint64{}}
+}
+
+// Poll fetches and decodes the endpoint once, giving up when ctx is done
+func (p *Poller[T]) Poll(ctx context.Context) {
+	start := time.Now()
+	value, n, err := p.fetchAndDecode(ctx)
+	duration := time.Since(start)
+
+	if err != nil {
+		p.logger.Warn("could not scrape", "stage", scrapeErrorStage(err), "err", err)
+	}
+
+	if err == nil && p.onSuccess != nil {
+		p.onSuccess(value)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.requests++
+	p.respBytes += uint64(n)
+	if err != nil {
+		p.errors[scrapeErrorStage(err)]++
+	}
+	p.lastErr = err
+	p.lastDuration = duration
+	if err == nil {
+		p.latest = value
+		p.hasLatest = true
+		p.lastSuccess = time.Now()
+	}
+}
+
+// fetchAndDecode returns the decoded response and how many bytes were received
+func (p *Poller[T]) fetchAndDecode(ctx context.Context) (T, int, error) {
+	var zero T
+	b, err := p.client.Get(ctx, p.url)
+	if err != nil {
+		return zero, 0, err
+	}
+	p.logger.Debug("response", "bytes", len(b), "body", string(b))
+
+	value, err := p.decode(b)
+	if err != nil {
+		return zero, len(b), &ScrapeError{Stage: stageDecode, Err: err}
+	}
+	return value, len(b), nil
+}
+
+// Run polls immediately, and then on every interval until ctx is done
+func (p *Poller[T]) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		p.Poll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Result returns the latest state of the poller
+func (p *Poller[T]) Result() PollResult[T] {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	errors := make(map[string]uint64, len(p.errors))
+	for stage, n := range p.errors {
+		errors[stage] = n
+	}
+	return PollResult[T]{
+		Latest:       p.latest,
+		HasLatest:    p.hasLatest,
+		LastSuccess:  p.lastSuccess,
+		LastErr:      p.lastErr,
+		LastDuration: p.lastDuration,
+		Requests:     p.requests,
+		RespBytes:    p.respBytes,
+		Errors:       errors,
+		CircuitState: p.client.State(),
+	}
+}
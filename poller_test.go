@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPollerServesScrapesFromCache(t *testing.T) {
+	var requests atomic.Int32
+	content := readFileContent(t, "./__source__/rawData6")
+	device := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		_, _ = w.Write(content)
+	}))
+	defer device.Close()
+
+	poller := polledOnce(device.URL, Decode)
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewSBMS0Collector(poller, newEnergyTracker(), defaultMetricPrefix, nil))
+	for i := 0; i < 5; i++ {
+		_, err := reg.Gather()
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, int32(1), requests.Load())
+}
+
+func TestPollerKeepsLastSnapshotWhenDeviceGoesAway(t *testing.T) {
+	device := serveContent(readFileContent(t, "./__source__/rawData6"), http.StatusOK)
+	poller := polledOnce(device.URL, Decode)
+	device.Close()
+	poller.Poll(context.Background())
+
+	result := poller.Result()
+	assert.True(t, result.HasLatest)
+	assert.NotNil(t, result.LastErr)
+	assert.Equal(t, float64(69), result.Latest.soc)
+	assert.True(t, time.Since(result.LastSuccess) < time.Minute)
+}
+
+func TestPollerRun(t *testing.T) {
+	var requests atomic.Int32
+	device := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		_, _ = w.Write(readFileContent(t, "./__source__/debug1"))
+	}))
+	defer device.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	poller := NewPoller(device.URL, 10*time.Millisecond, testClient(), slog.Default(), decodeDebug)
+	done := make(chan struct{})
+	go func() {
+		poller.Run(ctx)
+		close(done)
+	}()
+	assert.Eventually(t, func() bool { return requests.Load() >= 3 }, time.Second, time.Millisecond)
+	cancel()
+	<-done
+	assert.Len(t, poller.Result().Latest, 14)
+}
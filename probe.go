@@ -0,0 +1,65 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"log/slog"
+	"net/http"
+)
+
+const (
+	moduleRawData = "rawdata"
+	moduleDebug   = "debug"
+)
+
+// ProbeHandler scrapes the SBMS0 given by the target parameter into a registry of its own,
+// like the blackbox exporter, so one exporter can serve many devices via relabelling:
+//
+//	/probe?target=192.168.1.10&module=rawdata
+type ProbeHandler struct {
+	prefix  string
+	client  ClientConfig
+	flights *flightGroup
+}
+
+func (h ProbeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		http.Error(w, "target parameter is missing", http.StatusBadRequest)
+		return
+	}
+	module := r.URL.Query().Get("module")
+	if module == "" {
+		module = moduleRawData
+	}
+
+	logger := deviceLogger(slog.Default(), "", target)
+	reg := prometheus.NewPedanticRegistry()
+	switch module {
+	case moduleRawData:
+		u, err := getURL(target)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		poller := NewPoller(u, defaultPollInterval, NewDeviceClient(h.client, h.flights), logger, func(b []byte) (*SBMSData, error) {
+			return decodeRawData(b, logger)
+		})
+		poller.Poll(r.Context())
+		reg.MustRegister(NewSBMS0Collector(poller, newEnergyTracker(), h.prefix, nil))
+	case moduleDebug:
+		u, err := getDebugURL(target)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		poller := NewPoller(u, defaultPollInterval, NewDeviceClient(h.client, h.flights), logger, decodeDebug)
+		poller.Poll(r.Context())
+		reg.MustRegister(NewSBMS0SystemCollector(poller, h.prefix, nil))
+	default:
+		http.Error(w, "unknown module "+module, http.StatusBadRequest)
+		return
+	}
+
+	promhttp.HandlerFor(reg, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
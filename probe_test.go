@@ -0,0 +1,62 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func probe(target, module string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/probe?target="+target+"&module="+module, nil)
+	ProbeHandler{prefix: defaultMetricPrefix, client: testClientConfig()}.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestProbeRawData(t *testing.T) {
+	device := serveContent(readFileContent(t, "./__source__/rawData6"), http.StatusOK)
+	defer device.Close()
+
+	rec := probe(strings.TrimPrefix(device.URL, "http://")+"/rawData", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "sbms_up 1")
+	assert.Contains(t, rec.Body.String(), "sbms_battery_soc 69")
+}
+
+func TestProbeDebug(t *testing.T) {
+	device := serveContent(readFileContent(t, "./__source__/debug1"), http.StatusOK)
+	defer device.Close()
+
+	rec := probe(device.URL+"/debug", moduleDebug)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "sbms_up 1")
+	assert.Contains(t, rec.Body.String(), `sbms_system_task_priority{task="wifi"} 23`)
+}
+
+func TestProbeOfflineTarget(t *testing.T) {
+	device := serveContent(nil, http.StatusOK)
+	device.Close()
+
+	rec := probe(device.URL, moduleRawData)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "sbms_up 0")
+}
+
+func TestProbeBadRequests(t *testing.T) {
+	assert.Equal(t, http.StatusBadRequest, probe("", moduleRawData).Code)
+	assert.Equal(t, http.StatusBadRequest, probe("192.168.1.1", "nope").Code)
+}
+
+func TestProbeMetricPrefix(t *testing.T) {
+	device := serveContent(readFileContent(t, "./__source__/rawData6"), http.StatusOK)
+	defer device.Close()
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/probe?target="+device.URL+"/rawData", nil)
+	ProbeHandler{prefix: "solar", client: testClientConfig()}.ServeHTTP(rec, req)
+	assert.Contains(t, rec.Body.String(), "solar_up 1")
+	assert.Contains(t, rec.Body.String(), "solar_battery_soc 69")
+	assert.NotContains(t, rec.Body.String(), "# TYPE sbms_")
+}
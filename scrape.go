@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
+)
+
+// the stages of a scrape of the SBMS0 that can fail
+const (
+	stageHTTP   = "http"
+	stageRead   = "read"
+	stageDecode = "decode"
+)
+
+var scrapeStages = []string{stageHTTP, stageRead, stageDecode}
+
+// scrapeDescs describe the health of the scrapes of one SBMS0
+type scrapeDescs struct {
+	up             *prometheus.Desc
+	scrapeDuration *prometheus.Desc
+	snapshotAge    *prometheus.Desc
+	scrapeErrors   *prometheus.Desc
+	requests       *prometheus.Desc
+	respBytes      *prometheus.Desc
+	circuitState   *prometheus.Desc
+}
+
+func newScrapeDescs(prefix string, labels prometheus.Labels) scrapeDescs {
+	return scrapeDescs{
+		up:             prometheus.NewDesc(prefix+"_up", "Whether the last scrape of the SBMS0 succeeded", nil, labels),
+		scrapeDuration: prometheus.NewDesc(prefix+"_scrape_duration_seconds", "How long the last scrape of the SBMS0 took", nil, labels),
+		snapshotAge:    prometheus.NewDesc(prefix+"_snapshot_age_seconds", "Time since the SBMS0 was last scraped successfully", nil, labels),
+		scrapeErrors:   prometheus.NewDesc(prefix+"_scrape_errors_total", "Number of failed scrapes of the SBMS0, by the stage that failed", []string{"stage"}, labels),
+		requests:       prometheus.NewDesc(prefix+"_exporter_requests", "Number of requests made", nil, labels),
+		respBytes:      prometheus.NewDesc(prefix+"_exporter_resp_bytes", "Number of bytes received", nil, labels),
+		circuitState:   prometheus.NewDesc(prefix+"_device_circuit_state", "State of the circuit breaker of the SBMS0: 0 closed, 1 open, 2 half-open", nil, labels),
+	}
+}
+
+// ScrapeError records which stage of a scrape failed
+type ScrapeError struct {
+	Stage string
+	Err   error
+}
+
+func (e *ScrapeError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Stage, e.Err)
+}
+
+func (e *ScrapeError) Unwrap() error {
+	return e.Err
+}
+
+func (d scrapeDescs) describe(ch chan<- *prometheus.Desc) {
+	ch <- d.up
+	ch <- d.scrapeDuration
+	ch <- d.snapshotAge
+	ch <- d.scrapeErrors
+	ch <- d.requests
+	ch <- d.respBytes
+	ch <- d.circuitState
+}
+
+// scrapeErrorStage returns the stage of a scrape that err came from
+func scrapeErrorStage(err error) string {
+	if scrapeErr, ok := err.(*ScrapeError); ok {
+		return scrapeErr.Stage
+	}
+	return stageDecode
+}
+
+// exportPollResult sends sbms_up, sbms_scrape_duration_seconds and sbms_scrape_errors_total
+// for the last poll, and sbms_snapshot_age_seconds for the last successful one
+func exportPollResult[T any](ch chan<- prometheus.Metric, descs scrapeDescs, result PollResult[T]) {
+	up := 1.0
+	if result.LastErr != nil || !result.HasLatest {
+		up = 0
+	}
+	ch <- prometheus.MustNewConstMetric(descs.up, prometheus.GaugeValue, up)
+	ch <- prometheus.MustNewConstMetric(descs.scrapeDuration, prometheus.GaugeValue, result.LastDuration.Seconds())
+	if result.HasLatest {
+		ch <- prometheus.MustNewConstMetric(descs.snapshotAge, prometheus.GaugeValue, time.Since(result.LastSuccess).Seconds())
+	}
+	for _, stage := range scrapeStages {
+		ch <- prometheus.MustNewConstMetric(descs.scrapeErrors, prometheus.CounterValue, float64(result.Errors[stage]), stage)
+	}
+	ch <- prometheus.MustNewConstMetric(descs.requests, prometheus.CounterValue, float64(result.Requests))
+	ch <- prometheus.MustNewConstMetric(descs.respBytes, prometheus.CounterValue, float64(result.RespBytes))
+	ch <- prometheus.MustNewConstMetric(descs.circuitState, prometheus.GaugeValue, float64(result.CircuitState))
+}
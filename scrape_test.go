@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testClientConfig doesn't retry, so failing tests fail fast
+func testClientConfig() ClientConfig {
+	config := defaultClientConfig()
+	config.Retries = 0
+	return config
+}
+
+func testClient() *DeviceClient {
+	return NewDeviceClient(testClientConfig(), nil)
+}
+
+// polledOnce returns a poller of url that has polled once
+func polledOnce[T any](url string, decode func([]byte) (T, error)) *Poller[T] {
+	poller := NewPoller(url, defaultPollInterval, testClient(), slog.Default(), decode)
+	poller.Poll(context.Background())
+	return poller
+}
+
+func scrapeResult(stage string) string {
+	up := "1"
+	errors := map[string]string{stageHTTP: "0", stageRead: "0", stageDecode: "0"}
+	if stage != "" {
+		up = "0"
+		errors[stage] = "1"
+	}
+	return `
+# HELP sbms_scrape_errors_total Number of failed scrapes of the SBMS0, by the stage that failed
+# TYPE sbms_scrape_errors_total counter
+sbms_scrape_errors_total{stage="decode"} ` + errors[stageDecode] + `
+sbms_scrape_errors_total{stage="http"} ` + errors[stageHTTP] + `
+sbms_scrape_errors_total{stage="read"} ` + errors[stageRead] + `
+# HELP sbms_up Whether the last scrape of the SBMS0 succeeded
+# TYPE sbms_up gauge
+sbms_up ` + up + `
+`
+}
+
+func serveContent(content []byte, status int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		_, _ = w.Write(content)
+	}))
+}
+
+func TestCollectScrapeResult(t *testing.T) {
+	cases := map[string]struct {
+		content []byte
+		status  int
+		stage   string
+	}{
+		"ok":         {content: readFileContent(t, "./__source__/rawData6"), status: http.StatusOK},
+		"http error": {content: []byte("oops"), status: http.StatusInternalServerError, stage: stageHTTP},
+	}
+	for name, c := range cases {
+		device := serveContent(c.content, c.status)
+		reg := prometheus.NewPedanticRegistry()
+		reg.MustRegister(NewSBMS0Collector(polledOnce(device.URL, Decode), newEnergyTracker(), defaultMetricPrefix, nil))
+
+		err := testutil.GatherAndCompare(reg, strings.NewReader(scrapeResult(c.stage)), "sbms_up", "sbms_scrape_errors_total")
+		assert.Nil(t, err, name)
+		device.Close()
+	}
+}
+
+// TestCollectReportsDecodeError checks a rawData that can't be decoded is
+// counted as a decode error, with the typed error of Decode kept by the poller
+func TestCollectReportsDecodeError(t *testing.T) {
+	device := serveContent([]byte(`var sbms="short";`), http.StatusOK)
+	defer device.Close()
+
+	poller := polledOnce(device.URL, Decode)
+	var missing *MissingVariableError
+	assert.True(t, errors.As(poller.Result().LastErr, &missing))
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewSBMS0Collector(poller, newEnergyTracker(), defaultMetricPrefix, nil))
+	err := testutil.GatherAndCompare(reg, strings.NewReader(scrapeResult(stageDecode)), "sbms_up", "sbms_scrape_errors_total")
+	assert.Nil(t, err)
+}
+
+func TestCollectDeviceOffline(t *testing.T) {
+	device := serveContent(nil, http.StatusOK)
+	device.Close()
+
+	for _, collector := range []prometheus.Collector{
+		NewSBMS0Collector(polledOnce(device.URL, Decode), newEnergyTracker(), defaultMetricPrefix, nil),
+		NewSBMS0SystemCollector(polledOnce(device.URL, decodeDebug), defaultMetricPrefix, nil),
+	} {
+		reg := prometheus.NewPedanticRegistry()
+		reg.MustRegister(collector)
+		families, err := reg.Gather()
+		assert.Nil(t, err)
+		var up []float64
+		for _, f := range families {
+			if f.GetName() == "sbms_up" {
+				up = append(up, f.GetMetric()[0].GetGauge().GetValue())
+			}
+		}
+		assert.Equal(t, []float64{0}, up)
+	}
+}
+
+func describe(c prometheus.Collector) []string {
+	ch := make(chan *prometheus.Desc)
+	go func() {
+		c.Describe(ch)
+		close(ch)
+	}()
+	var descs []string
+	for d := range ch {
+		descs = append(descs, d.String())
+	}
+	return descs
+}
+
+func TestDescribeIsStatic(t *testing.T) {
+	device := serveContent(readFileContent(t, "./__source__/rawData12"), http.StatusOK)
+	defer device.Close()
+
+	polled := NewSBMS0Collector(polledOnce(device.URL, Decode), newEnergyTracker(), defaultMetricPrefix, nil)
+	unpolled := NewSBMS0Collector(NewPoller(device.URL, defaultPollInterval, testClient(), slog.Default(), Decode), newEnergyTracker(), defaultMetricPrefix, nil)
+	assert.Equal(t, describe(unpolled), describe(polled))
+
+	// the pedantic registry fails if a collected metric wasn't described
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(polled)
+	_, err := reg.Gather()
+	assert.Nil(t, err)
+}
+
+func TestCollectConcurrently(t *testing.T) {
+	shed := serveContent(readFileContent(t, "./__source__/rawData6"), http.StatusOK)
+	defer shed.Close()
+	boat := serveContent(readFileContent(t, "./__source__/rawData15"), http.StatusOK)
+	defer boat.Close()
+
+	shedReg := prometheus.NewPedanticRegistry()
+	shedReg.MustRegister(NewSBMS0Collector(polledOnce(shed.URL, Decode), newEnergyTracker(), defaultMetricPrefix, nil))
+	boatReg := prometheus.NewPedanticRegistry()
+	boatReg.MustRegister(NewSBMS0Collector(polledOnce(boat.URL, Decode), newEnergyTracker(), defaultMetricPrefix, nil))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, testutil.GatherAndCompare(shedReg, strings.NewReader(cellCount(8)), "sbms_cell_count"))
+		}()
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, testutil.GatherAndCompare(boatReg, strings.NewReader(cellCount(4)), "sbms_cell_count"))
+		}()
+	}
+	wg.Wait()
+}
+
+func cellCount(n int) string {
+	return fmt.Sprintf(`
+# HELP sbms_cell_count Number of cells detected in the battery
+# TYPE sbms_cell_count gauge
+sbms_cell_count %d
+`, n)
+}
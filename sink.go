@@ -0,0 +1,158 @@
+package main
+
+import (
+	"log/slog"
+	"reflect"
+	"sync"
+)
+
+// Sink is pushed every successful poll of the devices, unlike the Prometheus
+// endpoints, which serve the latest poll when they're scraped
+type Sink interface {
+	PublishRawData(device DeviceConfig, data *SBMSData)
+	PublishSystemTasks(device DeviceConfig, tasks []SystemTaskInfo)
+	// Close sends what is still queued and disconnects; closing again does nothing
+	Close()
+}
+
+// sinkKinds are the push sinks, in the order they're created
+var sinkKinds = []string{"mqtt", "influxdb", "otlp"}
+
+// sinkLookup finds what the exporter keeps of a device in its current config, as the
+// sinks outlive reloads
+type sinkLookup interface {
+	energy(device DeviceConfig) *energyTracker
+	rawDataResult(device DeviceConfig) (PollResult[*SBMSData], bool)
+}
+
+// runningSink is a push sink and the config it was created from
+type runningSink struct {
+	config any
+	sink   Sink
+}
+
+// sinkConfig is what the sink of kind is created from, or nil if config doesn't enable it
+func sinkConfig(config *Config, kind string) any {
+	switch {
+	case kind == "mqtt" && config.Sinks.MQTT.Enabled:
+		return config.Sinks.MQTT
+	case kind == "influxdb" && config.Sinks.InfluxDB.Enabled:
+		return []any{config.Sinks.InfluxDB, config.DeviceTimezone}
+	case kind == "otlp" && config.Sinks.OTLP.Enabled:
+		// the devices are part of it, as each one is a resource of the sink
+		return []any{config.Sinks.OTLP, config.MetricPrefix, config.PollInterval, config.Devices}
+	}
+	return nil
+}
+
+func newSink(config *Config, kind string, lookup sinkLookup) (Sink, error) {
+	switch kind {
+	case "mqtt":
+		return NewMQTTSink(config.Sinks.MQTT, lookup.energy)
+	case "influxdb":
+		return NewInfluxDBSink(config.Sinks.InfluxDB, config.deviceLocation())
+	default:
+		return NewOTLPSink(config.Sinks.OTLP, config.MetricPrefix, config.PollInterval, lookup.energy, lookup.rawDataResult)
+	}
+}
+
+// newSinks creates the push sinks enabled in config, keeping those of previous whose
+// config didn't change; lookup finds what the exporter keeps of a device. A changed sink of
+// previous is closed before its replacement connects, as they'd share e.g. the mqtt
+// client id and status topic, and knock each other off the broker.
+//
+// The sinks only fail to be created for an invalid config, and connect in the background,
+// so the configs are checked before any sink of previous is closed; a config that fails
+// leaves previous as it was.
+func newSinks(config *Config, previous map[string]runningSink, lookup sinkLookup) (map[string]runningSink, error) {
+	for _, validate := range []func() error{config.Sinks.MQTT.validate, config.Sinks.InfluxDB.validate, config.Sinks.OTLP.validate} {
+		if err := validate(); err != nil {
+			return nil, err
+		}
+	}
+	sinks := map[string]runningSink{}
+	for _, kind := range sinkKinds {
+		c := sinkConfig(config, kind)
+		if c == nil {
+			continue
+		}
+		old, ok := previous[kind]
+		if ok && reflect.DeepEqual(old.config, c) {
+			sinks[kind] = old
+			continue
+		}
+		if ok {
+			old.sink.Close()
+		}
+		sink, err := newSink(config, kind, lookup)
+		if err != nil {
+			for kind, created := range sinks {
+				if previous[kind].sink != created.sink {
+					created.sink.Close()
+				}
+			}
+			return nil, err
+		}
+		sinks[kind] = runningSink{config: c, sink: sink}
+	}
+	return sinks, nil
+}
+
+// closeSinks closes the sinks of previous that next doesn't keep; Close is safe to call twice
+func closeSinks(previous, next map[string]runningSink) {
+	for kind, old := range previous {
+		if next[kind].sink != old.sink {
+			old.sink.Close()
+		}
+	}
+}
+
+// sinkQueue hands updates from the pollers to the goroutine of a sink, so a slow
+// or unreachable sink never holds up polling; updates that don't fit are dropped
+type sinkQueue[T any] struct {
+	name    string
+	updates chan T
+	done    chan struct{}
+
+	// mu keeps push from sending on updates once it's closed
+	mu     sync.Mutex
+	closed bool
+}
+
+const sinkQueueSize = 64
+
+// newSinkQueue runs send on every update until close
+func newSinkQueue[T any](name string, send func(T)) *sinkQueue[T] {
+	q := &sinkQueue[T]{name: name, updates: make(chan T, sinkQueueSize), done: make(chan struct{})}
+	go func() {
+		defer close(q.done)
+		for update := range q.updates {
+			send(update)
+		}
+	}()
+	return q
+}
+
+func (q *sinkQueue[T]) push(update T) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	select {
+	case q.updates <- update:
+	default:
+		slog.Warn("sink queue is full, dropping update", "sink", q.name)
+	}
+}
+
+// close waits for the queued updates to be sent
+func (q *sinkQueue[T]) close() {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.updates)
+	}
+	q.mu.Unlock()
+	<-q.done
+}
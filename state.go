@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const defaultStateSaveInterval = time.Minute
+
+// StateConfig is where the energy totals are kept across restarts; nothing is kept without a path
+type StateConfig struct {
+	Path         string        `yaml:"path"`
+	SaveInterval time.Duration `yaml:"save_interval"`
+}
+
+func defaultStateConfig() StateConfig {
+	return StateConfig{SaveInterval: defaultStateSaveInterval}
+}
+
+func (c StateConfig) validate() error {
+	if c.SaveInterval <= 0 {
+		return fmt.Errorf("state save_interval must be positive, not %s", c.SaveInterval)
+	}
+	return nil
+}
+
+// energyRegisterState is what is kept of an energyRegister
+type energyRegisterState struct {
+	Last   float64 `json:"last"`
+	Offset float64 `json:"offset"`
+}
+
+// energyState is the state file, holding the registers of each device by their name
+type energyState struct {
+	Devices map[string]map[string]energyRegisterState `json:"devices"`
+}
+
+// loadEnergyState reads the state file at path, which doesn't have to exist yet
+func loadEnergyState(path string) (*energyState, error) {
+	state := &energyState{Devices: map[string]map[string]energyRegisterState{}}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, state); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if state.Devices == nil {
+		state.Devices = map[string]map[string]energyRegisterState{}
+	}
+	return state, nil
+}
+
+// save replaces the state file at path, through a temporary file so that
+// a crash while writing leaves the previous state in place
+func (s *energyState) save(path string) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// state is what is kept of the registers
+func (t *energyTracker) state() map[string]energyRegisterState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	registers := make(map[string]energyRegisterState, len(energyCounters))
+	for i, c := range energyCounters {
+		registers[c.name] = energyRegisterState{Last: t.registers[i].last, Offset: t.registers[i].offset}
+	}
+	return registers
+}
+
+// restore continues from registers; a device that was reset in the meantime
+// reads below the restored reading and is counted as a reset
+func (t *energyTracker) restore(registers map[string]energyRegisterState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, c := range energyCounters {
+		if r, ok := registers[c.name]; ok {
+			t.registers[i].last = r.Last
+			t.registers[i].offset = r.Offset
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnergyStateSaveAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	state, err := loadEnergyState(path)
+	assert.Nil(t, err)
+	assert.Empty(t, state.Devices)
+
+	tracker := newEnergyTracker()
+	tracker.observe(&SBMSData{batteryEnergyWh: 10})
+	tracker.observe(&SBMSData{batteryEnergyWh: 1})
+	tracker.observe(&SBMSData{batteryEnergyWh: 2})
+	state.Devices["shed"] = tracker.state()
+	assert.Nil(t, state.save(path))
+
+	loaded, err := loadEnergyState(path)
+	assert.Nil(t, err)
+	assert.Equal(t, energyRegisterState{Last: 2, Offset: 10}, loaded.Devices["shed"]["battery_wh"])
+
+	// no temporary files are left behind
+	entries, err := os.ReadDir(filepath.Dir(path))
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestEnergyStateInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	assert.Nil(t, os.WriteFile(path, []byte("{"), 0o644))
+	_, err := loadEnergyState(path)
+	assert.NotNil(t, err)
+}
+
+func TestEnergyTrackerRestore(t *testing.T) {
+	tracker := newEnergyTracker()
+	tracker.restore(map[string]energyRegisterState{"battery_wh": {Last: 100, Offset: 50}, "unknown": {Last: 1}})
+
+	// the device was reset while the exporter was down
+	tracker.observe(&SBMSData{batteryEnergyWh: 5})
+	tracker.observe(&SBMSData{batteryEnergyWh: 6})
+	assert.Equal(t, 156.0, tracker.registers[0].total())
+}
+
+func TestExporterRestoresEnergyState(t *testing.T) {
+	device := serveContent(readFileContent(t, "./__source__/rawData6"), http.StatusOK)
+	defer device.Close()
+
+	path := filepath.Join(t.TempDir(), "state.json")
+	state := &energyState{Devices: map[string]map[string]energyRegisterState{
+		"shed": {"battery_wh": {Last: 500000, Offset: 1000}},
+		"gone": {"battery_wh": {Last: 1}},
+	}}
+	assert.Nil(t, state.save(path))
+
+	config := configWithDevices(DeviceConfig{Name: "shed", URL: device.URL})
+	config.State.Path = path
+	var loadErr error
+	exporter := testExporter(t, &config, &loadErr)
+
+	// rawData6 reads less than was saved, which is held until the next poll confirms a reset
+	assert.Equal(t, energyRegisterState{Last: 500000, Offset: 1000}, exporter.current.Load().energy["shed"].state()["battery_wh"])
+
+	exporter.Close()
+	saved, err := loadEnergyState(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 1000.0, saved.Devices["shed"]["battery_wh"].Offset)
+	assert.Contains(t, saved.Devices, "gone")
+}
+
+// blockingSink holds up Close until release is closed
+type blockingSink struct {
+	closing, release chan struct{}
+}
+
+func (blockingSink) PublishRawData(DeviceConfig, *SBMSData)            {}
+func (blockingSink) PublishSystemTasks(DeviceConfig, []SystemTaskInfo) {}
+func (s blockingSink) Close() {
+	close(s.closing)
+	<-s.release
+}
+
+func TestExporterSavesStateBeforeClosingSinks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	config := configWithDevices(DeviceConfig{Name: "shed", URL: "127.0.0.1:1"})
+	config.State.Path = path
+	var loadErr error
+	exporter := testExporter(t, &config, &loadErr)
+	sink := blockingSink{closing: make(chan struct{}), release: make(chan struct{})}
+	exporter.current.Load().sinks = map[string]runningSink{"slow": {sink: sink}}
+
+	go exporter.Close()
+	<-sink.closing
+	saved, err := loadEnergyState(path)
+	assert.Nil(t, err)
+	assert.Contains(t, saved.Devices, "shed")
+	close(sink.release)
+}